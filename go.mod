@@ -7,6 +7,7 @@ toolchain go1.21.4
 require (
 	github.com/elgris/sqrl v0.0.0-20210727210741-7e0198b30236
 	github.com/google/uuid v1.6.0
+	github.com/lib/pq v1.10.9
 	github.com/pentops/sqrlx.go v0.0.0-20240523172712-b615a994d8c0
 	google.golang.org/protobuf v1.34.1
 )
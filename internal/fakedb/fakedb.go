@@ -0,0 +1,156 @@
+// Package fakedb is a scripted database/sql driver for tests which need a
+// connection but not a real database. Every statement, including BEGIN,
+// COMMIT and ROLLBACK, is passed to a Handler, which returns the rows or
+// the error the driver would.
+package fakedb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"sync"
+)
+
+// Result is the handler's response to a statement, rows for a query and
+// RowsAffected for an exec.
+type Result struct {
+	Columns      []string
+	Rows         [][]driver.Value
+	RowsAffected int64
+}
+
+type Handler func(query string, args []driver.NamedValue) (*Result, error)
+
+// DB records the statements it was given, in order.
+type DB struct {
+	*sql.DB
+
+	lock       sync.Mutex
+	statements []string
+}
+
+func Open(handler Handler) *DB {
+	db := &DB{}
+	db.DB = sql.OpenDB(&connector{
+		handler: func(query string, args []driver.NamedValue) (*Result, error) {
+			db.lock.Lock()
+			db.statements = append(db.statements, query)
+			db.lock.Unlock()
+			return handler(query, args)
+		},
+	})
+	return db
+}
+
+func (db *DB) Statements() []string {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return append([]string{}, db.statements...)
+}
+
+type connector struct {
+	handler Handler
+}
+
+func (c *connector) Connect(context.Context) (driver.Conn, error) {
+	return &conn{handler: c.handler}, nil
+}
+
+func (c *connector) Driver() driver.Driver {
+	return fakeDriver{}
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(string) (driver.Conn, error) {
+	return nil, errors.New("fakedb: use Open")
+}
+
+type conn struct {
+	handler Handler
+}
+
+func (c *conn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("fakedb: prepared statements are not supported")
+}
+
+func (c *conn) Close() error {
+	return nil
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *conn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) {
+	if _, err := c.handler("BEGIN", nil); err != nil {
+		return nil, err
+	}
+	return &tx{conn: c}, nil
+}
+
+func (c *conn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	result, err := c.handler(query, args)
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		result = &Result{}
+	}
+	return &rows{result: result}, nil
+}
+
+func (c *conn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	result, err := c.handler(query, args)
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		result = &Result{}
+	}
+	return driver.RowsAffected(result.RowsAffected), nil
+}
+
+// CheckNamedValue accepts any argument, so that the handler sees values
+// as the caller passed them.
+func (c *conn) CheckNamedValue(*driver.NamedValue) error {
+	return nil
+}
+
+type tx struct {
+	conn *conn
+}
+
+func (t *tx) Commit() error {
+	_, err := t.conn.handler("COMMIT", nil)
+	return err
+}
+
+func (t *tx) Rollback() error {
+	_, err := t.conn.handler("ROLLBACK", nil)
+	return err
+}
+
+type rows struct {
+	result *Result
+	next   int
+}
+
+func (r *rows) Columns() []string {
+	return r.result.Columns
+}
+
+func (r *rows) Close() error {
+	return nil
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+	if r.next >= len(r.result.Rows) {
+		return io.EOF
+	}
+	copy(dest, r.result.Rows[r.next])
+	r.next++
+	return nil
+}
@@ -0,0 +1,93 @@
+// Package pgtest connects tests to the Postgres database in TEST_DB, e.g.
+// postgres://postgres@localhost/outbox_test?sslmode=disable. Tests which
+// need a database are skipped when it isn't set.
+package pgtest
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	sq "github.com/elgris/sqrl"
+	_ "github.com/lib/pq"
+	"github.com/pentops/sqrlx.go/sqrlx"
+)
+
+// DB is a connection pool whose search path is a new, empty schema, which
+// is dropped when the test ends. Each test can then create its own tables.
+func DB(tb testing.TB) *sqrlx.Wrapper {
+	tb.Helper()
+	dsn := os.Getenv("TEST_DB")
+	if dsn == "" {
+		tb.Skip("TEST_DB is not set")
+	}
+
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { admin.Close() })
+
+	suffix := make([]byte, 6)
+	if _, err := rand.Read(suffix); err != nil {
+		tb.Fatal(err)
+	}
+	schema := "pgtest_" + hex.EncodeToString(suffix)
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		if _, err := admin.Exec("DROP SCHEMA " + schema + " CASCADE"); err != nil {
+			tb.Error(err)
+		}
+	})
+
+	conn, err := sql.Open("postgres", withSearchPath(dsn, schema))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+
+	db, err := sqrlx.New(conn, sq.Dollar)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return db
+}
+
+// withSearchPath adds a search_path run-time parameter, which lib/pq passes
+// to the server, to a URL or key=value connection string.
+func withSearchPath(dsn string, schema string) string {
+	if !strings.HasPrefix(dsn, "postgres://") && !strings.HasPrefix(dsn, "postgresql://") {
+		return dsn + " search_path=" + schema
+	}
+	parsed, err := url.Parse(dsn)
+	if err != nil {
+		return dsn
+	}
+	query := parsed.Query()
+	query.Set("search_path", schema)
+	parsed.RawQuery = query.Encode()
+	return parsed.String()
+}
+
+// Exec runs each statement in its own transaction, failing the test on the
+// first error, e.g. to create the tables for a test.
+func Exec(tb testing.TB, db *sqrlx.Wrapper, statements ...string) {
+	tb.Helper()
+	for _, statement := range statements {
+		if err := db.Transact(context.Background(), &sqrlx.TxOptions{
+			Isolation: sql.LevelReadCommitted,
+		}, func(ctx context.Context, tx sqrlx.Transaction) error {
+			_, err := tx.ExecRaw(ctx, statement)
+			return err
+		}); err != nil {
+			tb.Fatalf("%s: %s", statement, err)
+		}
+	}
+}
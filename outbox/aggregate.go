@@ -0,0 +1,90 @@
+package outbox
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	sq "github.com/elgris/sqrl"
+	"github.com/pentops/sqrlx.go/sqrlx"
+)
+
+// Headers set by SendForAggregate, so consumers can order and check for
+// gaps per aggregate regardless of the table layout.
+const (
+	AggregateTypeHeader     = "aggregate-type"
+	AggregateIDHeader       = "aggregate-id"
+	AggregateSequenceHeader = "aggregate-sequence"
+)
+
+// SendForAggregate sends the messages for one aggregate in a single insert,
+// numbering them with the aggregate's next sequence numbers. Sequences are
+// allocated from SequenceTable, which needs the columns aggregate_type,
+// aggregate_id and sequence, with a unique key on the first two:
+//
+//	CREATE TABLE outbox_aggregate_sequence (
+//		aggregate_type text NOT NULL,
+//		aggregate_id text NOT NULL,
+//		sequence bigint NOT NULL,
+//		PRIMARY KEY (aggregate_type, aggregate_id)
+//	);
+//
+// The upsert locks the aggregate's row until tx ends, so concurrent
+// transactions for the same aggregate commit in sequence order. Sequenced
+// messages are never compacted, which would leave gaps. Messages which
+// can't be encoded are reported together in a BatchError, as by SendBatch.
+func (ss *NamedSender) SendForAggregate(ctx context.Context, tx sqrlx.Transaction, aggregateType string, aggregateID string, msgs ...OutboxMessage) error {
+	start := time.Now()
+	if err := requireTransaction(tx); err != nil {
+		return err
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	batchErr := &BatchError{Size: len(msgs)}
+	raws := make([]*Raw, len(msgs))
+	for idx, msg := range msgs {
+		raw, err := ss.encode(msg)
+		if err != nil {
+			batchErr.add(idx, nil, msg.MessagingTopic(), err)
+			raws[idx] = &Raw{Destination: msg.MessagingTopic()}
+			continue
+		}
+		raw.AggregateType = aggregateType
+		raw.AggregateID = aggregateID
+		raw.setHeader(AggregateTypeHeader, aggregateType)
+		raw.setHeader(AggregateIDHeader, aggregateID)
+		raws[idx] = raw
+	}
+	if len(batchErr.Failures) > 0 {
+		ss.observeBatch(start, batchErr, raws)
+		return batchErr
+	}
+
+	if ss.SequenceTable != "" {
+		last, err := ss.allocateSequence(ctx, tx, aggregateType, aggregateID, uint64(len(raws)))
+		if err != nil {
+			return err
+		}
+		first := last - uint64(len(raws)) + 1
+		for idx, raw := range raws {
+			raw.AggregateSequence = first + uint64(idx)
+			raw.setHeader(AggregateSequenceHeader, strconv.FormatUint(raw.AggregateSequence, 10))
+		}
+	}
+
+	return ss.sendRawBatch(ctx, tx, raws, start)
+}
+
+// allocateSequence reserves count sequence numbers, returning the last.
+func (ss *NamedSender) allocateSequence(ctx context.Context, tx sqrlx.Transaction, aggregateType string, aggregateID string, count uint64) (uint64, error) {
+	var last uint64
+	err := tx.QueryRow(ctx, sq.Expr(
+		"INSERT INTO "+ss.SequenceTable+" (aggregate_type, aggregate_id, sequence) VALUES (?, ?, ?)"+
+			" ON CONFLICT (aggregate_type, aggregate_id) DO UPDATE SET sequence = "+ss.SequenceTable+".sequence + EXCLUDED.sequence"+
+			" RETURNING sequence",
+		aggregateType, aggregateID, count,
+	)).Scan(&last)
+	return last, err
+}
@@ -0,0 +1,82 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	sq "github.com/elgris/sqrl"
+	"github.com/pentops/sqrlx.go/sqrlx"
+)
+
+// undelivered restricts a query to messages which haven't been acked, when
+// the sender has a DeliveredAtColumn.
+func (ss *NamedSender) undelivered(query *sq.SelectBuilder) *sq.SelectBuilder {
+	if ss.DeliveredAtColumn == "" {
+		return query
+	}
+	return query.Where(sq.Eq{ss.DeliveredAtColumn: nil})
+}
+
+// ArchiveDeliveredBatch moves up to limit messages marked by AckBatch to the
+// ArchiveTable, oldest delivery first, in one statement. Rows locked by
+// another mover are skipped. Returns the number of messages moved.
+func (ss *NamedSender) ArchiveDeliveredBatch(ctx context.Context, tx sqrlx.Transaction, limit uint64) (int64, error) {
+	if ss.ArchiveTable == "" || ss.DeliveredAtColumn == "" {
+		return 0, fmt.Errorf("%w: ArchiveDelivered needs an ArchiveTable and DeliveredAtColumn", ErrUnsupportedSender)
+	}
+
+	deleteStatement, args, err := sq.Delete(ss.TableName).
+		Where(sq.Expr(ss.IDColumn+" IN (?)", sq.Select(ss.IDColumn).
+			From(ss.TableName).
+			Where(sq.NotEq{ss.DeliveredAtColumn: nil}).
+			OrderBy(ss.DeliveredAtColumn).
+			Limit(limit).
+			Suffix("FOR UPDATE SKIP LOCKED"))).
+		Suffix("RETURNING *").
+		ToSql()
+	if err != nil {
+		return 0, err
+	}
+	result, err := tx.Exec(ctx, sq.Expr("WITH delivered AS ("+deleteStatement+") INSERT INTO "+ss.ArchiveTable+" SELECT * FROM delivered", args...))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// ArchiveDelivered moves delivered messages to the ArchiveTable every
+// interval, in transactions of up to batch messages, until the backlog is
+// cleared or ctx is done. Several movers can run against one table. Returns
+// nil once ctx is done, or the first failure.
+func (ss *NamedSender) ArchiveDelivered(ctx context.Context, db sqrlx.Transactor, interval time.Duration, batch uint64) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for {
+			var moved int64
+			if err := db.Transact(ctx, &sqrlx.TxOptions{
+				ReadOnly:  false,
+				Isolation: sql.LevelReadCommitted,
+			}, func(ctx context.Context, tx sqrlx.Transaction) error {
+				var err error
+				moved, err = ss.ArchiveDeliveredBatch(ctx, tx, batch)
+				return err
+			}); err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return err
+			}
+			if uint64(moved) < batch {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/pentops/outbox.pg.go/internal/pgtest"
+	"github.com/pentops/sqrlx.go/sqrlx"
+)
+
+const archiveBenchRows = 10000
+
+// archiveBenchSender creates an outbox and archive table, skipping without
+// TEST_DB.
+func archiveBenchSender(tb testing.TB) (*sqrlx.Wrapper, *NamedSender) {
+	db := pgtest.DB(tb)
+	pgtest.Exec(tb, db,
+		"CREATE TABLE outbox (id text PRIMARY KEY, destination text NOT NULL, headers text NOT NULL, message bytea NOT NULL, delivered_at timestamptz)",
+		"CREATE INDEX outbox_delivered ON outbox (delivered_at) WHERE delivered_at IS NOT NULL",
+		"CREATE TABLE outbox_archive (LIKE outbox)",
+	)
+	sender := NewNamedSender(DefaultConfig())
+	sender.ArchiveTable = "outbox_archive"
+	sender.DeliveredAtColumn = "delivered_at"
+	return db, sender
+}
+
+func archiveBenchTx(tb testing.TB, db *sqrlx.Wrapper, cb func(context.Context, sqrlx.Transaction) error) {
+	if err := db.Transact(context.Background(), &sqrlx.TxOptions{
+		Isolation: sql.LevelReadCommitted,
+	}, cb); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// fillDelivered inserts archiveBenchRows messages which have been acked.
+func fillDelivered(tb testing.TB, db *sqrlx.Wrapper) {
+	archiveBenchTx(tb, db, func(ctx context.Context, tx sqrlx.Transaction) error {
+		_, err := tx.ExecRaw(ctx, "INSERT INTO outbox SELECT gen_random_uuid()::text, 'bench.v1.Topic', 'grpc-service=%2Fbench.v1.Topic%2FEvent', convert_to(repeat('x', 256), 'UTF8'), now() FROM generate_series(1, $1)", archiveBenchRows)
+		return err
+	})
+}
+
+// BenchmarkArchiveDelivered compares ArchiveDeliveredBatch with moving each
+// row in its own pair of statements. Each op moves archiveBenchRows rows,
+// run with TEST_DB set, e.g.
+//
+//	TEST_DB=postgres://postgres@localhost/outbox_test?sslmode=disable go test -run xxx -bench ArchiveDelivered ./outbox/
+func BenchmarkArchiveDelivered(b *testing.B) {
+	b.Run("set-based", func(b *testing.B) {
+		db, sender := archiveBenchSender(b)
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			fillDelivered(b, db)
+			b.StartTimer()
+
+			for {
+				var moved int64
+				archiveBenchTx(b, db, func(ctx context.Context, tx sqrlx.Transaction) error {
+					var err error
+					moved, err = sender.ArchiveDeliveredBatch(ctx, tx, 1000)
+					return err
+				})
+				if moved < 1000 {
+					break
+				}
+			}
+		}
+		b.ReportMetric(float64(archiveBenchRows*b.N)/b.Elapsed().Seconds(), "rows/s")
+	})
+
+	b.Run("row-by-row", func(b *testing.B) {
+		db, _ := archiveBenchSender(b)
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			fillDelivered(b, db)
+			b.StartTimer()
+
+			archiveBenchTx(b, db, func(ctx context.Context, tx sqrlx.Transaction) error {
+				rows, err := tx.QueryRaw(ctx, "SELECT id FROM outbox WHERE delivered_at IS NOT NULL")
+				if err != nil {
+					return err
+				}
+				ids := []string{}
+				for rows.Next() {
+					var id string
+					if err := rows.Scan(&id); err != nil {
+						return err
+					}
+					ids = append(ids, id)
+				}
+				rows.Close()
+				for _, id := range ids {
+					if _, err := tx.ExecRaw(ctx, "INSERT INTO outbox_archive SELECT * FROM outbox WHERE id = $1", id); err != nil {
+						return err
+					}
+					if _, err := tx.ExecRaw(ctx, "DELETE FROM outbox WHERE id = $1", id); err != nil {
+						return err
+					}
+				}
+				return rows.Err()
+			})
+		}
+		b.ReportMetric(float64(archiveBenchRows*b.N)/b.Elapsed().Seconds(), "rows/s")
+	})
+}
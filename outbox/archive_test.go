@@ -0,0 +1,163 @@
+package outbox
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	sq "github.com/elgris/sqrl"
+	"github.com/pentops/sqrlx.go/sqrlx"
+)
+
+func TestAckBatchStatements(t *testing.T) {
+	archived := func() *NamedSender {
+		sender := NewNamedSender(DefaultConfig())
+		sender.ArchiveTable = "outbox_archive"
+		return sender
+	}
+
+	for _, tc := range []struct {
+		name   string
+		sender func() *NamedSender
+		want   []string
+	}{{
+		name: "no archive",
+		sender: func() *NamedSender {
+			return NewNamedSender(DefaultConfig())
+		},
+		want: []string{
+			"DELETE FROM outbox WHERE id IN (?,?)",
+		},
+	}, {
+		name:   "archive",
+		sender: archived,
+		want: []string{
+			"WITH acked AS (DELETE FROM outbox WHERE id IN (?,?) RETURNING *) INSERT INTO outbox_archive SELECT * FROM acked",
+		},
+	}, {
+		name: "archive with deleted destinations",
+		sender: func() *NamedSender {
+			sender := archived()
+			sender.Retention = map[string]RetentionPolicy{"noisy.v1.Topic": {Delete: true}}
+			return sender
+		},
+		want: []string{
+			"DELETE FROM outbox WHERE id IN (?,?) AND destination IN (?)",
+			"WITH acked AS (DELETE FROM outbox WHERE id IN (?,?) AND destination NOT IN (?) RETURNING *) INSERT INTO outbox_archive SELECT * FROM acked",
+		},
+	}, {
+		name: "marked for ArchiveDelivered",
+		sender: func() *NamedSender {
+			sender := archived()
+			sender.DeliveredAtColumn = "delivered_at"
+			sender.Retention = map[string]RetentionPolicy{"noisy.v1.Topic": {Delete: true}}
+			return sender
+		},
+		want: []string{
+			"DELETE FROM outbox WHERE id IN (?,?) AND destination IN (?)",
+			"UPDATE outbox SET delivered_at = now() WHERE id IN (?,?) AND destination NOT IN (?)",
+		},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			tx := &recordingTx{}
+			if err := tc.sender().AckBatch(context.Background(), tx, "a", "b"); err != nil {
+				t.Fatal(err)
+			}
+			if len(tx.statements) != len(tc.want) {
+				t.Fatalf("got statements %q, want %q", tx.statements, tc.want)
+			}
+			for idx, want := range tc.want {
+				if tx.statements[idx] != want {
+					t.Errorf("statement %d: got %q, want %q", idx, tx.statements[idx], want)
+				}
+			}
+		})
+	}
+}
+
+func TestArchiveDeliveredBatchStatement(t *testing.T) {
+	sender := NewNamedSender(DefaultConfig())
+	sender.ArchiveTable = "outbox_archive"
+	sender.DeliveredAtColumn = "delivered_at"
+
+	tx := &recordingTx{}
+	moved, err := sender.ArchiveDeliveredBatch(context.Background(), tx, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 1 {
+		t.Errorf("got %d moved, want the rows affected", moved)
+	}
+	want := "WITH delivered AS (DELETE FROM outbox WHERE id IN (SELECT id FROM outbox WHERE delivered_at IS NOT NULL ORDER BY delivered_at LIMIT 500 FOR UPDATE SKIP LOCKED) RETURNING *) INSERT INTO outbox_archive SELECT * FROM delivered"
+	if tx.statements[0] != want {
+		t.Errorf("got %q, want %q", tx.statements[0], want)
+	}
+}
+
+func TestClaimSkipsDelivered(t *testing.T) {
+	sender := NewNamedSender(DefaultConfig())
+	sender.DeliveredAtColumn = "delivered_at"
+	statement, _, err := sender.undelivered(sq.Select(sender.IDColumn).From(sender.TableName)).ToSql()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "SELECT id FROM outbox WHERE delivered_at IS NULL"; statement != want {
+		t.Errorf("got %q, want %q", statement, want)
+	}
+}
+
+func TestArchiveDelivered(t *testing.T) {
+	db, sender := archiveBenchSender(t)
+	fillDelivered(t, db)
+	archiveBenchTx(t, db, func(ctx context.Context, tx sqrlx.Transaction) error {
+		_, err := tx.ExecRaw(ctx, "INSERT INTO outbox (id, destination, headers, message) VALUES ('pending', 'bench.v1.Topic', '', '')")
+		return err
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- sender.ArchiveDelivered(ctx, db, time.Hour, 3000)
+	}()
+
+	// the first pass clears the backlog without waiting for the interval
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var archived int
+		archiveBenchTx(t, db, func(ctx context.Context, tx sqrlx.Transaction) error {
+			return tx.QueryRowRaw(ctx, "SELECT count(*) FROM outbox_archive").Scan(&archived)
+		})
+		if archived == archiveBenchRows {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d archived", archived, archiveBenchRows)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	var remaining []string
+	archiveBenchTx(t, db, func(ctx context.Context, tx sqrlx.Transaction) error {
+		remaining = []string{}
+		rows, err := tx.QueryRaw(ctx, "SELECT id FROM outbox")
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				return err
+			}
+			remaining = append(remaining, id)
+		}
+		return rows.Err()
+	})
+	if len(remaining) != 1 || remaining[0] != "pending" {
+		t.Errorf("got %q left in the outbox, want the pending message", remaining)
+	}
+}
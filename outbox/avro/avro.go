@@ -0,0 +1,153 @@
+// Package avro sends Avro payloads through the outbox with Confluent Schema
+// Registry framing: a zero magic byte and the big-endian schema ID, followed
+// by the Avro binary encoding.
+//
+// The Avro encoding itself is left to an Encoder, so that callers can use
+// whichever Avro library they already depend on.
+package avro
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/pentops/outbox.pg.go/outbox"
+)
+
+// ContentType is set on every Raw message built by a Codec.
+const ContentType = "application/vnd.confluent.avro"
+
+const magicByte = 0
+
+// Frame prefixes the Avro encoded data with the registry framing.
+func Frame(schemaID uint32, data []byte) []byte {
+	framed := make([]byte, 5, 5+len(data))
+	framed[0] = magicByte
+	binary.BigEndian.PutUint32(framed[1:5], schemaID)
+	return append(framed, data...)
+}
+
+// Unframe splits framed data into the schema ID and Avro encoded data.
+func Unframe(framed []byte) (uint32, []byte, error) {
+	if len(framed) < 5 || framed[0] != magicByte {
+		return 0, nil, fmt.Errorf("avro: data is not schema registry framed")
+	}
+	return binary.BigEndian.Uint32(framed[1:5]), framed[5:], nil
+}
+
+// Encoder encodes a value with the Avro binary encoding of the schema.
+type Encoder func(schema string, value any) ([]byte, error)
+
+// Registry resolves the ID of a schema under a subject, registering it if
+// required.
+type Registry interface {
+	SchemaID(ctx context.Context, subject string, schema string) (uint32, error)
+}
+
+// RegistryClient is a minimal Confluent Schema Registry client, caching the
+// schema IDs it has resolved.
+type RegistryClient struct {
+	BaseURL    string
+	HTTPClient *http.Client
+
+	ids sync.Map
+}
+
+func NewRegistryClient(baseURL string) *RegistryClient {
+	return &RegistryClient{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		HTTPClient: http.DefaultClient,
+	}
+}
+
+// SchemaID registers the schema under the subject, which returns the
+// existing ID when the schema is already registered.
+func (rc *RegistryClient) SchemaID(ctx context.Context, subject string, schema string) (uint32, error) {
+	key := subject + "\x00" + schema
+	if id, ok := rc.ids.Load(key); ok {
+		return id.(uint32), nil
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"schema": schema,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, rc.BaseURL+"/subjects/"+url.PathEscape(subject)+"/versions", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+
+	res, err := rc.HTTPClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("avro: registering schema for %s: %w", subject, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("avro: registering schema for %s: status %d", subject, res.StatusCode)
+	}
+
+	registered := struct {
+		ID uint32 `json:"id"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&registered); err != nil {
+		return 0, fmt.Errorf("avro: decoding registry response for %s: %w", subject, err)
+	}
+
+	rc.ids.Store(key, registered.ID)
+	return registered.ID, nil
+}
+
+// Codec builds framed Avro outbox messages.
+type Codec struct {
+	Registry Registry
+	Encoder  Encoder
+
+	// Subject returns the registry subject for a destination, defaults to
+	// the Confluent TopicNameStrategy, "<destination>-value".
+	Subject func(destination string) string
+}
+
+func NewCodec(registry Registry, encoder Encoder) *Codec {
+	return &Codec{
+		Registry: registry,
+		Encoder:  encoder,
+	}
+}
+
+func (c *Codec) subject(destination string) string {
+	if c.Subject != nil {
+		return c.Subject(destination)
+	}
+	return destination + "-value"
+}
+
+// Raw encodes the value with the schema, ready for outbox.SendRaw.
+func (c *Codec) Raw(ctx context.Context, destination string, schema string, value any, headers url.Values) (*outbox.Raw, error) {
+	schemaID, err := c.Registry.SchemaID(ctx, c.subject(destination), schema)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := c.Encoder(schema, value)
+	if err != nil {
+		return nil, fmt.Errorf("avro: encoding %s: %w", destination, err)
+	}
+
+	return &outbox.Raw{
+		Destination: destination,
+		Headers:     headers,
+		Body:        Frame(schemaID, data),
+		ContentType: ContentType,
+	}, nil
+}
@@ -0,0 +1,69 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/pentops/sqrlx.go/sqrlx"
+)
+
+type transactionContextKey struct{}
+
+// ContextWithTransaction marks ctx as running in tx, so that a BoundSender
+// writes to it rather than opening a transaction of its own.
+func ContextWithTransaction(ctx context.Context, tx sqrlx.Transaction) context.Context {
+	return context.WithValue(ctx, transactionContextKey{}, tx)
+}
+
+// TransactionFromContext returns the transaction set by
+// ContextWithTransaction, or nil.
+func TransactionFromContext(ctx context.Context) sqrlx.Transaction {
+	tx, _ := ctx.Value(transactionContextKey{}).(sqrlx.Transaction)
+	return tx
+}
+
+// BoundSender is a Sender bound to a database, for fire-and-forget messages
+// such as audit pings. Send joins the caller's transaction when ctx carries
+// one, otherwise the message is written in its own short transaction, and
+// is not atomic with anything else the caller does.
+type BoundSender struct {
+	db     sqrlx.Transactor
+	sender Sender
+
+	// Options for the transactions opened by Send
+	TxOptions *sqrlx.TxOptions
+}
+
+// NewBoundSender binds sender to db, a nil sender uses DefaultSender.
+func NewBoundSender(db sqrlx.Transactor, sender Sender) *BoundSender {
+	return &BoundSender{
+		db:     db,
+		sender: sender,
+		TxOptions: &sqrlx.TxOptions{
+			ReadOnly:  false,
+			Retryable: true,
+			Isolation: sql.LevelReadCommitted,
+		},
+	}
+}
+
+func (bs *BoundSender) Send(ctx context.Context, msgs ...OutboxMessage) error {
+	sender := bs.sender
+	if sender == nil {
+		sender = DefaultSender
+	}
+
+	send := func(ctx context.Context, tx sqrlx.Transaction) error {
+		for _, msg := range msgs {
+			if err := sender.Send(ctx, tx, msg); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if tx := TransactionFromContext(ctx); tx != nil {
+		return send(ctx, tx)
+	}
+	return bs.db.Transact(ctx, bs.TxOptions, send)
+}
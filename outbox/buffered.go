@@ -0,0 +1,108 @@
+package outbox
+
+import (
+	"context"
+
+	"github.com/pentops/sqrlx.go/sqrlx"
+)
+
+// BufferedSender holds messages in memory and writes them with a single
+// multi-row insert on Flush. Messages are only in the outbox once Flush has
+// succeeded within the same transaction: anything still buffered when the
+// transaction commits is lost. BufferedTransact flushes before commit and
+// is the intended way to use it.
+//
+// A BufferedSender belongs to a single transaction and is not safe for
+// concurrent use.
+type BufferedSender struct {
+	sender  *NamedSender
+	pending []*Raw
+
+	// Collapses messages with the same destination and idempotency-key
+	// header into the first one buffered, for handlers which may raise the
+	// same event more than once in a transaction.
+	Dedupe bool
+}
+
+func NewBufferedSender(sender *NamedSender) *BufferedSender {
+	return &BufferedSender{
+		sender: sender,
+	}
+}
+
+// Send buffers the message, tx is only checked here and written by Flush.
+func (bs *BufferedSender) Send(ctx context.Context, tx sqrlx.Transaction, msg OutboxMessage, opts ...SendOption) error {
+	_, err := bs.SendReturningID(ctx, tx, msg, opts...)
+	return err
+}
+
+// SendReturningID buffers the message, returning the ID it will be written
+// with.
+func (bs *BufferedSender) SendReturningID(ctx context.Context, tx sqrlx.Transaction, msg OutboxMessage, opts ...SendOption) (string, error) {
+	raw, err := bs.sender.encode(msg, opts...)
+	if err != nil {
+		return "", err
+	}
+	return bs.SendRawReturningID(ctx, tx, raw)
+}
+
+func (bs *BufferedSender) SendTo(ctx context.Context, tx sqrlx.Transaction, destination string, msg OutboxMessage, opts ...SendOption) error {
+	raw, err := bs.sender.encode(msg, opts...)
+	if err != nil {
+		return err
+	}
+	raw.Destination = destination
+	return bs.SendRaw(ctx, tx, raw)
+}
+
+func (bs *BufferedSender) SendRaw(ctx context.Context, tx sqrlx.Transaction, raw *Raw) error {
+	_, err := bs.SendRawReturningID(ctx, tx, raw)
+	return err
+}
+
+func (bs *BufferedSender) SendRawReturningID(ctx context.Context, tx sqrlx.Transaction, raw *Raw) (string, error) {
+	if err := requireTransaction(tx); err != nil {
+		return "", err
+	}
+	raw = bs.sender.withContextHeaders(ctx, raw)
+	if bs.Dedupe {
+		if key := raw.Headers.Get(IdempotencyKeyHeader); key != "" {
+			for _, pending := range bs.pending {
+				if pending.Destination == raw.Destination && pending.Headers.Get(IdempotencyKeyHeader) == key {
+					return pending.ID, nil
+				}
+			}
+		}
+	}
+	if raw.ID == "" {
+		withID := *raw
+		withID.ID = bs.sender.messageID(raw)
+		raw = &withID
+	}
+	bs.pending = append(bs.pending, raw)
+	return raw.ID, nil
+}
+
+func (bs *BufferedSender) Flush(ctx context.Context, tx sqrlx.Transaction) error {
+	if len(bs.pending) == 0 {
+		return nil
+	}
+	if err := bs.sender.SendRawBatch(ctx, tx, bs.pending...); err != nil {
+		return err
+	}
+	bs.pending = nil
+	return nil
+}
+
+// BufferedTransact runs cb in a transaction with a new BufferedSender, and
+// flushes it after cb returns, before the transaction commits. A failed
+// flush rolls back the transaction. Retried transactions get a fresh buffer.
+func BufferedTransact(ctx context.Context, db sqrlx.Transactor, opts *sqrlx.TxOptions, sender *NamedSender, cb func(context.Context, sqrlx.Transaction, *BufferedSender) error) error {
+	return db.Transact(ctx, opts, func(ctx context.Context, tx sqrlx.Transaction) error {
+		buffered := NewBufferedSender(sender)
+		if err := cb(ctx, tx, buffered); err != nil {
+			return err
+		}
+		return buffered.Flush(ctx, tx)
+	})
+}
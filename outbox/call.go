@@ -0,0 +1,112 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/pentops/sqrlx.go/sqrlx"
+)
+
+// Headers for request/response messaging over the outbox.
+const (
+	ReplyToHeader       = "reply-to"
+	CorrelationIDHeader = "correlation-id"
+)
+
+// Call sends a request asking for the reply to be sent to replyTopic,
+// returning the correlation ID which the reply will carry.
+func (ss *NamedSender) Call(ctx context.Context, tx sqrlx.Transaction, request OutboxMessage, replyTopic string) (string, error) {
+	raw, err := ss.encode(request)
+	if err != nil {
+		return "", err
+	}
+	correlationID := uuid.NewString()
+	raw.setHeader(ReplyToHeader, replyTopic)
+	raw.setHeader(CorrelationIDHeader, correlationID)
+	if err := ss.SendRaw(ctx, tx, raw); err != nil {
+		return "", err
+	}
+	return correlationID, nil
+}
+
+// Reply sends the response to the reply-to destination of a request sent by
+// Call, in place of the response's own topic.
+func (ss *NamedSender) Reply(ctx context.Context, tx sqrlx.Transaction, request *Delivery, response OutboxMessage) error {
+	replyTo := request.Headers.Get(ReplyToHeader)
+	correlationID := request.Headers.Get(CorrelationIDHeader)
+	if replyTo == "" || correlationID == "" {
+		return fmt.Errorf("message %s on %s does not expect a reply", request.ID, request.Destination)
+	}
+
+	raw, err := ss.encode(response)
+	if err != nil {
+		return err
+	}
+	raw.Destination = replyTo
+	raw.setHeader(CorrelationIDHeader, correlationID)
+	return ss.SendRaw(ctx, tx, raw)
+}
+
+// ReplyWaiter routes replies received on a reply topic to the caller
+// waiting for them, for callers which consume their own reply topic in the
+// same process.
+type ReplyWaiter struct {
+	lock    sync.Mutex
+	waiting map[string]chan *Delivery
+}
+
+func NewReplyWaiter() *ReplyWaiter {
+	return &ReplyWaiter{
+		waiting: map[string]chan *Delivery{},
+	}
+}
+
+// Expect registers a correlation ID, which must happen before the reply can
+// be delivered so that it isn't dropped.
+func (rw *ReplyWaiter) Expect(correlationID string) {
+	rw.lock.Lock()
+	defer rw.lock.Unlock()
+	rw.waiting[correlationID] = make(chan *Delivery, 1)
+}
+
+// Deliver passes a received reply to its caller, returning false if nothing
+// is expecting it or it is a duplicate.
+func (rw *ReplyWaiter) Deliver(reply *Delivery) bool {
+	rw.lock.Lock()
+	defer rw.lock.Unlock()
+	waiting, ok := rw.waiting[reply.Headers.Get(CorrelationIDHeader)]
+	if !ok {
+		return false
+	}
+	select {
+	case waiting <- reply:
+		return true
+	default:
+		return false
+	}
+}
+
+// Await blocks until the reply arrives or ctx is done.
+func (rw *ReplyWaiter) Await(ctx context.Context, correlationID string) (*Delivery, error) {
+	rw.lock.Lock()
+	waiting, ok := rw.waiting[correlationID]
+	rw.lock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("not expecting a reply for %s", correlationID)
+	}
+
+	defer func() {
+		rw.lock.Lock()
+		delete(rw.waiting, correlationID)
+		rw.lock.Unlock()
+	}()
+
+	select {
+	case reply := <-waiting:
+		return reply, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,223 @@
+package outbox
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+
+	sq "github.com/elgris/sqrl"
+	"github.com/pentops/sqrlx.go/sqrlx"
+)
+
+// Delivery is a message read back out of the outbox table.
+type Delivery struct {
+	ID          string
+	Destination string
+	Headers     url.Values
+	Data        []byte
+}
+
+// ContentHash is a hex SHA-256 of the destination and body, for broker
+// deduplication keyed on content rather than on ID, e.g. an SQS FIFO
+// MessageDeduplicationId. ID suits brokers which dedupe per message, e.g. a
+// JetStream Msg-Id.
+func (delivery *Delivery) ContentHash() string {
+	hash := sha256.New()
+	hash.Write([]byte(delivery.Destination))
+	hash.Write([]byte{0})
+	hash.Write(delivery.Data)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// ClaimBatch locks up to limit messages in the outbox table, skipping rows
+// already locked by another transaction, so that several relays can drain the
+// same table. With a PriorityColumn, higher priority messages are claimed
+// first. The claim lasts for the life of tx: call AckBatch for the
+// messages which were delivered, and commit. Rolling back tx releases every
+// claimed message for the next claim.
+func (ss *NamedSender) ClaimBatch(ctx context.Context, tx sqrlx.Transaction, limit uint64) ([]*Delivery, error) {
+	return ss.claim(ctx, tx, limit, claimFilter{})
+}
+
+// ClaimDestination is ClaimBatch for the messages of one destination.
+func (ss *NamedSender) ClaimDestination(ctx context.Context, tx sqrlx.Transaction, destination string, limit uint64) ([]*Delivery, error) {
+	return ss.claim(ctx, tx, limit, claimFilter{destination: destination})
+}
+
+// ClaimEach is ClaimBatch calling back with each message as it is read,
+// rather than holding the whole batch in memory. The rows are still open
+// during the callback, so it must not use tx; ack the delivered IDs once
+// ClaimEach returns. An error from the callback stops the claim and is
+// returned.
+func (ss *NamedSender) ClaimEach(ctx context.Context, tx sqrlx.Transaction, limit uint64, callback func(*Delivery) error) error {
+	return ss.claimEach(ctx, tx, limit, claimFilter{}, callback)
+}
+
+// claimFilter restricts a claim, an empty filter claims any message.
+type claimFilter struct {
+	destination string
+	ids         []string
+
+	// claims one hash range of the partition key when partitions is set
+	partition  uint32
+	partitions uint32
+
+	// reads without locking, see Peek
+	peek bool
+}
+
+// ClaimPartition is ClaimBatch for one of partitions hash ranges of the
+// partition key, the AggregateIDColumn, or the ID when it isn't set. Giving
+// each relay instance its own partition keeps every aggregate on one
+// instance, which then claims its messages in order of
+// AggregateSequenceColumn and CreatedAtColumn, where set. PriorityColumn is
+// ignored when partitioning by aggregate, as it would let a later message
+// for an aggregate overtake an earlier one; partitioned by ID it orders the
+// claim first. Assignment of partitions to instances is static.
+func (ss *NamedSender) ClaimPartition(ctx context.Context, tx sqrlx.Transaction, partition uint32, partitions uint32, limit uint64) ([]*Delivery, error) {
+	if partitions == 0 || partition >= partitions {
+		return nil, fmt.Errorf("outbox: partition %d of %d", partition, partitions)
+	}
+	return ss.claim(ctx, tx, limit, claimFilter{partition: partition, partitions: partitions})
+}
+
+func (ss *NamedSender) claim(ctx context.Context, tx sqrlx.Transaction, limit uint64, filter claimFilter) ([]*Delivery, error) {
+	deliveries := []*Delivery{}
+	if err := ss.claimEach(ctx, tx, limit, filter, func(delivery *Delivery) error {
+		deliveries = append(deliveries, delivery)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+func (ss *NamedSender) claimEach(ctx context.Context, tx sqrlx.Transaction, limit uint64, filter claimFilter, callback func(*Delivery) error) error {
+	if !filter.peek {
+		if paused, err := ss.migrationPaused(ctx, tx); err != nil {
+			return err
+		} else if paused {
+			return nil
+		}
+	}
+
+	lock := "FOR UPDATE SKIP LOCKED"
+	if filter.peek {
+		lock = ""
+	}
+	query := sq.Select(ss.IDColumn, ss.DestinationColumn, ss.HeadersColumn, ss.DataColumn).
+		From(ss.TableName).
+		Limit(limit).
+		Suffix(ss.withComment(ctx, lock, filter.destination))
+	query = ss.undelivered(query)
+	if filter.destination != "" {
+		query = query.Where(sq.Eq{ss.DestinationColumn: filter.destination})
+	}
+	if filter.ids != nil {
+		query = query.Where(sq.Eq{ss.IDColumn: filter.ids})
+	}
+	if filter.partitions > 0 {
+		keyColumn := ss.AggregateIDColumn
+		if keyColumn == "" {
+			keyColumn = ss.IDColumn
+		}
+		query = query.Where(sq.Expr("mod(abs(hashtext("+keyColumn+"::text)::bigint), ?) = ?", filter.partitions, filter.partition))
+	}
+	if filter.partitions > 0 && ss.AggregateIDColumn != "" {
+		// an aggregate's sequence, allocated under a row lock, is its send
+		// order, where created_at is when each transaction began
+		if ss.AggregateSequenceColumn != "" {
+			query = query.OrderBy(ss.AggregateSequenceColumn)
+		}
+		if ss.CreatedAtColumn != "" {
+			query = query.OrderBy(ss.CreatedAtColumn)
+		}
+	} else {
+		if ss.PriorityColumn != "" {
+			query = query.OrderBy(ss.PriorityColumn + " DESC")
+		}
+		if filter.partitions > 0 || filter.peek {
+			if ss.CreatedAtColumn != "" {
+				query = query.OrderBy(ss.CreatedAtColumn)
+			}
+			if ss.AggregateSequenceColumn != "" {
+				query = query.OrderBy(ss.AggregateSequenceColumn)
+			}
+		}
+	}
+
+	rows, err := tx.Select(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var headers string
+		delivery := &Delivery{}
+		if err := rows.Scan(&delivery.ID, &delivery.Destination, &headers, &delivery.Data); err != nil {
+			return err
+		}
+		delivery.Headers, err = DecodeHeaders(headers)
+		if err != nil {
+			return fmt.Errorf("message %s: %w", delivery.ID, err)
+		}
+		if err := callback(delivery); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// AckBatch removes delivered messages from the outbox table, moving them to
+// the ArchiveTable when set, or marking them for ArchiveDelivered with a
+// DeliveredAtColumn. Messages which are claimed but not acked stay in the
+// table and are released when tx ends.
+func (ss *NamedSender) AckBatch(ctx context.Context, tx sqrlx.Transaction, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	if ss.ArchiveTable == "" {
+		_, err := tx.Delete(ctx, sq.Delete(ss.TableName).
+			Where(sq.Eq{ss.IDColumn: ids}))
+		return err
+	}
+
+	// destinations which aren't archived are deleted on delivery
+	deleted := ss.deletedDestinations()
+	if len(deleted) > 0 {
+		if _, err := tx.Delete(ctx, sq.Delete(ss.TableName).
+			Where(sq.Eq{ss.IDColumn: ids}).
+			Where(sq.Eq{ss.DestinationColumn: deleted})); err != nil {
+			return err
+		}
+	}
+
+	if ss.DeliveredAtColumn != "" {
+		mark := sq.Update(ss.TableName).
+			Set(ss.DeliveredAtColumn, sq.Expr("now()")).
+			Where(sq.Eq{ss.IDColumn: ids})
+		if len(deleted) > 0 {
+			mark = mark.Where(sq.NotEq{ss.DestinationColumn: deleted})
+		}
+		_, err := tx.Update(ctx, mark)
+		return err
+	}
+
+	// one set-based statement for the batch, rather than a round trip per
+	// row
+	archive := sq.Delete(ss.TableName).
+		Where(sq.Eq{ss.IDColumn: ids}).
+		Suffix("RETURNING *")
+	if len(deleted) > 0 {
+		archive = archive.Where(sq.NotEq{ss.DestinationColumn: deleted})
+	}
+	deleteStatement, args, err := archive.ToSql()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, sq.Expr("WITH acked AS ("+deleteStatement+") INSERT INTO "+ss.ArchiveTable+" SELECT * FROM acked", args...))
+	return err
+}
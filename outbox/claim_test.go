@@ -0,0 +1,77 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"testing"
+
+	sq "github.com/elgris/sqrl"
+	"github.com/pentops/outbox.pg.go/internal/fakedb"
+	"github.com/pentops/sqrlx.go/sqrlx"
+)
+
+func TestClaimOrder(t *testing.T) {
+	withColumns := func(ss *NamedSender) {
+		ss.PriorityColumn = "priority"
+		ss.CreatedAtColumn = "created_at"
+		ss.AggregateSequenceColumn = "aggregate_sequence"
+	}
+	for _, tc := range []struct {
+		name   string
+		config func(*NamedSender)
+		claim  func(context.Context, *NamedSender, sqrlx.Transaction) error
+		want   string
+	}{{
+		name:   "batch by priority",
+		config: withColumns,
+		claim: func(ctx context.Context, ss *NamedSender, tx sqrlx.Transaction) error {
+			_, err := ss.ClaimBatch(ctx, tx, 10)
+			return err
+		},
+		want: " ORDER BY priority DESC",
+	}, {
+		name:   "partitioned by ID",
+		config: withColumns,
+		claim: func(ctx context.Context, ss *NamedSender, tx sqrlx.Transaction) error {
+			_, err := ss.ClaimPartition(ctx, tx, 0, 4, 10)
+			return err
+		},
+		want: " ORDER BY priority DESC, created_at, aggregate_sequence",
+	}, {
+		// priority would let a later message for the aggregate overtake
+		name: "partitioned by aggregate",
+		config: func(ss *NamedSender) {
+			withColumns(ss)
+			ss.AggregateIDColumn = "aggregate_id"
+		},
+		claim: func(ctx context.Context, ss *NamedSender, tx sqrlx.Transaction) error {
+			_, err := ss.ClaimPartition(ctx, tx, 0, 4, 10)
+			return err
+		},
+		want: " ORDER BY aggregate_sequence, created_at",
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			conn := fakedb.Open(func(string, []driver.NamedValue) (*fakedb.Result, error) {
+				return &fakedb.Result{}, nil
+			})
+			db, err := sqrlx.New(conn.DB, sq.Dollar)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sender := NewNamedSender(DefaultConfig())
+			tc.config(sender)
+
+			if err := db.Transact(context.Background(), &sqrlx.TxOptions{
+				Isolation: sql.LevelReadCommitted,
+			}, func(ctx context.Context, tx sqrlx.Transaction) error {
+				return tc.claim(ctx, sender, tx)
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if order := selectOrder(t, conn); order != tc.want {
+				t.Errorf("got %q, want %q", order, tc.want)
+			}
+		})
+	}
+}
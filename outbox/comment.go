@@ -0,0 +1,62 @@
+package outbox
+
+import (
+	"context"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// DestinationCommentKey is added to the SQL comment of statements for a
+// single destination.
+const DestinationCommentKey = "destination"
+
+// withComment appends a sqlcommenter comment to statement, e.g.
+// /*destination='foo.v1.Topic',traceparent='00-...'*/. Keys and values are
+// percent encoded, which also escapes quotes, '*/' and placeholder marks.
+func (ss *NamedSender) withComment(ctx context.Context, statement string, destination string) string {
+	if ss.SQLComment == nil {
+		return statement
+	}
+	values := ss.SQLComment(ctx)
+	if destination != "" {
+		withDestination := make(map[string]string, len(values)+1)
+		for k, v := range values {
+			withDestination[k] = v
+		}
+		withDestination[DestinationCommentKey] = destination
+		values = withDestination
+	}
+	if len(values) == 0 {
+		return statement
+	}
+
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, commentEscape(k)+"='"+commentEscape(values[k])+"'")
+	}
+	return statement + " /*" + strings.Join(pairs, ",") + "*/"
+}
+
+func commentEscape(value string) string {
+	return strings.ReplaceAll(url.QueryEscape(value), "+", "%20")
+}
+
+// batchDestination is the destination shared by every message, or empty.
+func batchDestination(raws []*Raw) string {
+	if len(raws) == 0 {
+		return ""
+	}
+	for _, raw := range raws[1:] {
+		if raw.Destination != raws[0].Destination {
+			return ""
+		}
+	}
+	return raws[0].Destination
+}
@@ -0,0 +1,58 @@
+package outbox
+
+import (
+	"context"
+	"testing"
+)
+
+func TestWithComment(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name        string
+		values      map[string]string
+		destination string
+		want        string
+	}{{
+		name: "no values",
+		want: "SELECT 1",
+	}, {
+		name:        "destination only",
+		destination: "foo.v1.Topic",
+		want:        "SELECT 1 /*destination='foo.v1.Topic'*/",
+	}, {
+		name:        "sorted keys",
+		values:      map[string]string{"traceparent": "00-abc-def-01", "application": "api"},
+		destination: "foo.v1.Topic",
+		want:        "SELECT 1 /*application='api',destination='foo.v1.Topic',traceparent='00-abc-def-01'*/",
+	}, {
+		name:   "quotes",
+		values: map[string]string{"route": "it's", "k'ey": "v"},
+		want:   "SELECT 1 /*k%27ey='v',route='it%27s'*/",
+	}, {
+		name:   "comment terminator",
+		values: map[string]string{"route": "a*/DROP TABLE outbox;/*"},
+		want:   "SELECT 1 /*route='a%2A%2FDROP%20TABLE%20outbox%3B%2F%2A'*/",
+	}, {
+		name:   "placeholders",
+		values: map[string]string{"route": "?$1"},
+		want:   "SELECT 1 /*route='%3F%241'*/",
+	}, {
+		name:   "spaces and plus",
+		values: map[string]string{"a b": "c+d"},
+		want:   "SELECT 1 /*a%20b='c%2Bd'*/",
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			sender := NewNamedSender(DefaultConfig())
+			sender.SQLComment = func(context.Context) map[string]string {
+				return tc.values
+			}
+			if got := sender.withComment(ctx, "SELECT 1", tc.destination); got != tc.want {
+				t.Errorf("got %s, want %s", got, tc.want)
+			}
+		})
+	}
+
+	if got := NewNamedSender(DefaultConfig()).withComment(ctx, "SELECT 1", "foo.v1.Topic"); got != "SELECT 1" {
+		t.Errorf("without SQLComment, got %s", got)
+	}
+}
@@ -0,0 +1,69 @@
+package outbox
+
+import (
+	"context"
+
+	sq "github.com/elgris/sqrl"
+	"github.com/pentops/sqrlx.go/sqrlx"
+)
+
+// CompactionKeyHeader marks messages which supersede any earlier message
+// for the same destination and key, e.g. the latest state of a search
+// document.
+const CompactionKeyHeader = "compaction-key"
+
+// compact drops undelivered messages superseded by the new ones, when the
+// sender has a CompactionKeyColumn. Messages claimed by a relay are skipped
+// rather than waited for; they are already being delivered. Earlier
+// duplicates within the new messages are dropped as well. Messages with an
+// aggregate sequence neither compact nor are compacted, as consumers would
+// see the gap.
+func (ss *NamedSender) compact(ctx context.Context, tx sqrlx.Transaction, raws []*Raw) ([]*Raw, error) {
+	if ss.CompactionKeyColumn == "" {
+		return raws, nil
+	}
+
+	type compactionKey struct {
+		destination string
+		key         string
+	}
+	latest := map[compactionKey]int{}
+	for idx, raw := range raws {
+		if raw.AggregateSequence != 0 {
+			continue
+		}
+		if key := raw.Headers.Get(CompactionKeyHeader); key != "" {
+			latest[compactionKey{raw.Destination, key}] = idx
+		}
+	}
+	if len(latest) == 0 {
+		return raws, nil
+	}
+
+	for key := range latest {
+		superseded := ss.undelivered(sq.Select(ss.IDColumn).
+			From(ss.TableName).
+			Where(sq.Eq{
+				ss.DestinationColumn:   key.destination,
+				ss.CompactionKeyColumn: key.key,
+			}).
+			Suffix("FOR UPDATE SKIP LOCKED"))
+		if ss.AggregateSequenceColumn != "" {
+			superseded = superseded.Where(sq.Eq{ss.AggregateSequenceColumn: nil})
+		}
+		if _, err := tx.Delete(ctx, sq.Delete(ss.TableName).
+			Where(sq.Expr(ss.IDColumn+" IN (?)", superseded)),
+		); err != nil {
+			return nil, err
+		}
+	}
+
+	kept := make([]*Raw, 0, len(raws))
+	for idx, raw := range raws {
+		if key := raw.Headers.Get(CompactionKeyHeader); key != "" && raw.AggregateSequence == 0 && latest[compactionKey{raw.Destination, key}] != idx {
+			continue
+		}
+		kept = append(kept, raw)
+	}
+	return kept, nil
+}
@@ -0,0 +1,76 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func compactionSender() *NamedSender {
+	sender := NewNamedSender(DefaultConfig())
+	sender.CompactionKeyColumn = "compaction_key"
+	sender.AggregateSequenceColumn = "aggregate_sequence"
+	return sender
+}
+
+func compactionRaw(key string, sequence uint64) *Raw {
+	return &Raw{
+		Destination:       "test.v1.Topic",
+		Headers:           url.Values{CompactionKeyHeader: {key}},
+		AggregateSequence: sequence,
+	}
+}
+
+func TestCompactSkipsSequencedMessages(t *testing.T) {
+	ctx := context.Background()
+	sender := compactionSender()
+
+	tx := &recordingTx{}
+	raws := []*Raw{compactionRaw("k1", 1), compactionRaw("k1", 2)}
+	kept, err := sender.compact(ctx, tx, raws)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kept) != 2 {
+		t.Errorf("kept %d of 2 sequenced messages", len(kept))
+	}
+	if len(tx.statements) != 0 {
+		t.Errorf("sequenced messages compacted stored rows: %q", tx.statements)
+	}
+
+	// unsequenced messages leave sequenced rows in place
+	tx = &recordingTx{}
+	kept, err = sender.compact(ctx, tx, []*Raw{compactionRaw("k1", 0), compactionRaw("k1", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kept) != 1 {
+		t.Errorf("kept %d of 2 unsequenced messages, want the latest", len(kept))
+	}
+	if len(tx.statements) != 1 || !strings.Contains(tx.statements[0], "aggregate_sequence IS NULL") {
+		t.Errorf("got %q, want a delete of unsequenced rows", tx.statements)
+	}
+}
+
+func TestSendForAggregateEncodeErrors(t *testing.T) {
+	sender := NewNamedSender(DefaultConfig())
+	tx := &recordingTx{}
+	err := sender.SendForAggregate(context.Background(), tx, "order", "o-1",
+		benchMessage(0),
+		&testMessage{StringValue: wrapperspb.String("\xff"), topic: "bad.v1.Topic"},
+	)
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("got %v, want a BatchError", err)
+	}
+	if batchErr.Size != 2 || len(batchErr.Failures) != 1 || batchErr.Failures[0].Index != 1 || batchErr.Failures[0].Destination != "bad.v1.Topic" {
+		t.Errorf("got %+v, want message 1 of 2 on bad.v1.Topic", batchErr)
+	}
+	if len(tx.statements) != 0 {
+		t.Errorf("got %q, want nothing written", tx.statements)
+	}
+}
@@ -0,0 +1,71 @@
+package outbox
+
+// Config is the storage layout of an outbox table. NamedSender and
+// outboxtest.OutboxAsserter both embed it, so a column added to the table
+// is configured once for the sender and its assertions.
+type Config struct {
+	TableName         string
+	IDColumn          string
+	HeadersColumn     string
+	DataColumn        string
+	DestinationColumn string
+
+	// Optional, written when set. Messages without an aggregate use the
+	// destination as the type and the message ID as the ID.
+	AggregateTypeColumn string
+	AggregateIDColumn   string
+
+	// Optional, see SendForAggregate. The sequence column is NULL for
+	// messages sent without one.
+	AggregateSequenceColumn string
+
+	// Optional, holds the region header
+	RegionColumn string
+
+	// Optional, holds the compaction-key header. When set, a message with
+	// the header replaces undelivered messages with the same destination
+	// and key, other than aggregate sequenced messages.
+	CompactionKeyColumn string
+
+	// Optional, a timestamp column with a default of now(), read by Stats
+	// for the age of the oldest message
+	CreatedAtColumn string
+
+	// Optional, written when set, and ClaimBatch claims the highest
+	// priority messages first
+	PriorityColumn string
+
+	// Optional, AckBatch moves delivered messages to this table, which must
+	// have the same columns in the same order
+	ArchiveTable string
+
+	// Optional, a nullable timestamp column. With an ArchiveTable, AckBatch
+	// sets it rather than moving the message, and ArchiveDelivered moves
+	// the delivered messages in batches. Claims skip delivered messages.
+	DeliveredAtColumn string
+
+	// Encoding of the headers column, defaults to HeaderEncodingURL
+	HeaderEncoding HeaderEncoding
+
+	// Stores proto payloads wrapped in an anypb.Any
+	AnyPayload bool
+}
+
+// DefaultConfig is the layout used by DefaultSender.
+func DefaultConfig() Config {
+	return Config{
+		TableName:         "outbox",
+		IDColumn:          "id",
+		HeadersColumn:     "headers",
+		DataColumn:        "message",
+		DestinationColumn: "destination",
+	}
+}
+
+// NewNamedSender returns a sender for the layout, the remaining options
+// can be set on the result.
+func NewNamedSender(config Config) *NamedSender {
+	return &NamedSender{
+		Config: config,
+	}
+}
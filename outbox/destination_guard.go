@@ -0,0 +1,58 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+)
+
+// DestinationGuard is a SendGuard which fails sends to destinations outside
+// of the allowed patterns, e.g. to stop a staging deployment emitting to
+// prod.billing.* topics. Patterns use path.Match syntax, so * matches any
+// run of characters, including dots.
+type DestinationGuard struct {
+	// When set, destinations must match at least one
+	Allow []string
+	Deny  []string
+}
+
+func NewDestinationGuard(allow []string, deny []string) (*DestinationGuard, error) {
+	for _, pattern := range append(append([]string{}, allow...), deny...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("destination pattern %q: %w", pattern, err)
+		}
+	}
+	return &DestinationGuard{
+		Allow: allow,
+		Deny:  deny,
+	}, nil
+}
+
+// NewEnvironmentDestinationGuard picks the guard for the environment named
+// in envVar, e.g. ENV. Environments without an entry have no restrictions.
+func NewEnvironmentDestinationGuard(envVar string, byEnvironment map[string]*DestinationGuard) *DestinationGuard {
+	if guard, ok := byEnvironment[os.Getenv(envVar)]; ok {
+		return guard
+	}
+	return &DestinationGuard{}
+}
+
+func matchAny(patterns []string, destination string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, destination); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (dg *DestinationGuard) CheckSend(ctx context.Context, raw *Raw) error {
+	if matchAny(dg.Deny, raw.Destination) {
+		return fmt.Errorf("%w: %s is denied", ErrDestinationNotAllowed, raw.Destination)
+	}
+	if len(dg.Allow) > 0 && !matchAny(dg.Allow, raw.Destination) {
+		return fmt.Errorf("%w: %s is not allowed", ErrDestinationNotAllowed, raw.Destination)
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package outbox
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/pentops/sqrlx.go/sqrlx"
+)
+
+// ErrNoTransaction is returned when sending without a transaction. A message
+// written outside of the business transaction is no longer atomic with it,
+// which is the point of the outbox.
+var ErrNoTransaction = errors.New("outbox: send requires a transaction")
+
+// ErrBacklogExceeded is returned by a BacklogGuard which rejects sends.
+var ErrBacklogExceeded = errors.New("outbox: destination backlog exceeded")
+
+// ErrQuotaExceeded is returned by a BacklogGuard which rejects sends to a
+// destination over its byte quota.
+var ErrQuotaExceeded = errors.New("outbox: destination storage quota exceeded")
+
+// ErrBackpressure is returned by a BackpressureGuard, so that producers can
+// shed optional traffic to a severely backlogged destination.
+var ErrBackpressure = errors.New("outbox: destination backlogged")
+
+// ErrInjectedFault is the default error of a FaultInjector.
+var ErrInjectedFault = errors.New("outbox: injected publish fault")
+
+// ErrDeliveryHeld is returned by a Canary for messages it holds back.
+var ErrDeliveryHeld = errors.New("outbox: delivery held")
+
+// ErrDestinationNotAllowed is returned by a DestinationGuard.
+var ErrDestinationNotAllowed = errors.New("outbox: destination not allowed")
+
+// ErrUnknownHeader is returned by a HeaderGuard.
+var ErrUnknownHeader = errors.New("outbox: unknown header")
+
+// ErrPayloadTooLarge is returned when a message body exceeds
+// NamedSender.MaxPayloadBytes.
+var ErrPayloadTooLarge = errors.New("outbox: payload too large")
+
+// ErrNoMessages is returned, or fails the test in outboxtest, when no
+// message matched the expected destination or matcher.
+var ErrNoMessages = errors.New("outbox: no messages")
+
+// ErrMalformedHeaders is returned when a stored headers value can't be
+// decoded.
+var ErrMalformedHeaders = errors.New("outbox: malformed headers")
+
+// ErrSchemaMismatch is matched by the SchemaError from CheckSchema.
+var ErrSchemaMismatch = errors.New("outbox: schema does not match sender")
+
+// ErrUnsupportedSender is returned by the package level functions when
+// DefaultSender does not implement the required method.
+var ErrUnsupportedSender = errors.New("outbox: unsupported by default sender")
+
+// ErrCallerTransaction is returned by a transaction from FromSQLTx for
+// operations which would begin or reset the transaction its caller owns.
+var ErrCallerTransaction = errors.New("outbox: transaction is owned by the caller")
+
+// DeliveryError is returned by consumer helpers, e.g. VersionRouter, when a
+// message could not be handled. Retryable is false when the same message
+// will always fail, so should be dead-lettered rather than redelivered.
+type DeliveryError struct {
+	MessageID   string
+	Destination string
+	Retryable   bool
+	Err         error
+}
+
+func (err *DeliveryError) Error() string {
+	return fmt.Sprintf("delivering message %s on %s: %s", err.MessageID, err.Destination, err.Err)
+}
+
+func (err *DeliveryError) Unwrap() error {
+	return err.Err
+}
+
+// SchemaError is returned by CheckSchema when configured columns are missing
+// from the database, as table.column.
+type SchemaError struct {
+	Missing []string
+}
+
+func (err *SchemaError) Error() string {
+	return fmt.Sprintf("%s: missing %s", ErrSchemaMismatch, strings.Join(err.Missing, ", "))
+}
+
+func (err *SchemaError) Unwrap() error {
+	return ErrSchemaMismatch
+}
+
+// BatchError is returned by batch sends when individual messages are
+// refused, e.g. by encoding or a SendGuard. Nothing in the batch is written.
+// Errors from the insert itself apply to the whole batch and are returned
+// as they are.
+type BatchError struct {
+	Size     int
+	Failures []*BatchFailure
+}
+
+// BatchFailure is the error for the message at Index in the batch.
+// MessageID is empty unless the message was given an ID before sending.
+type BatchFailure struct {
+	Index       int
+	MessageID   string
+	Destination string
+	Err         error
+}
+
+func (err *BatchError) Error() string {
+	if len(err.Failures) == 1 {
+		failure := err.Failures[0]
+		return fmt.Sprintf("message %d of %d on %s: %s", failure.Index, err.Size, failure.Destination, failure.Err)
+	}
+	return fmt.Sprintf("%d of %d messages failed, first at %d on %s: %s", len(err.Failures), err.Size, err.Failures[0].Index, err.Failures[0].Destination, err.Failures[0].Err)
+}
+
+// Unwrap allows errors.Is and errors.As to match any of the failures.
+func (err *BatchError) Unwrap() []error {
+	errs := make([]error, 0, len(err.Failures))
+	for _, failure := range err.Failures {
+		errs = append(errs, failure.Err)
+	}
+	return errs
+}
+
+func (err *BatchError) add(index int, raw *Raw, destination string, failure error) {
+	batchFailure := &BatchFailure{
+		Index:       index,
+		Destination: destination,
+		Err:         failure,
+	}
+	if raw != nil {
+		batchFailure.MessageID = raw.ID
+	}
+	err.Failures = append(err.Failures, batchFailure)
+}
+
+// sqrlx.Transaction can only be satisfied by a transaction wrapper (a
+// non-transactional sqrlx.WrapperCommander has no TxExtras), which leaves
+// a nil interface as the only way to send outside of one.
+func requireTransaction(tx sqrlx.Transaction) error {
+	if tx == nil {
+		return ErrNoTransaction
+	}
+	return nil
+}
+
+// IsRetryable reports whether err is a serialization failure or deadlock,
+// which a retry of the whole transaction can resolve. It is meant for
+// sqrlx.Wrapper.ShouldRetryTransaction, whose default only matches an
+// unwrapped lib/pq serialization failure, while statement errors reach
+// the callback wrapped in sqrlx.QueryError.
+func IsRetryable(err error) bool {
+	switch sqlState(err) {
+	case "40001", "40P01":
+		return true
+	}
+	return false
+}
+
+// sqlState returns the SQLSTATE of the driver error in err's chain, or an
+// empty string. pgconn.PgError and pq.Error have a SQLState method, older
+// lib/pq versions only Get('C').
+func sqlState(err error) string {
+	var stateErr interface{ SQLState() string }
+	if errors.As(err, &stateErr) {
+		return stateErr.SQLState()
+	}
+	var fieldErr interface{ Get(byte) string }
+	if errors.As(err, &fieldErr) {
+		return fieldErr.Get('C')
+	}
+	return ""
+}
@@ -0,0 +1,68 @@
+// Package events collects domain events raised by an aggregate during
+// business logic, to be sent through the outbox in the transaction which
+// saves the aggregate.
+package events
+
+import (
+	"context"
+
+	"github.com/pentops/outbox.pg.go/outbox"
+	"github.com/pentops/sqrlx.go/sqrlx"
+)
+
+// BatchSender is satisfied by outbox.NamedSender.
+type BatchSender interface {
+	SendBatch(ctx context.Context, tx sqrlx.Transaction, msgs ...outbox.OutboxMessage) error
+}
+
+// Collector holds events until they are flushed. The zero value is ready
+// to use, and is meant to be embedded in the aggregate:
+//
+//	type Order struct {
+//		events.Collector
+//		...
+//	}
+//
+//	func (o *Order) Cancel() {
+//		o.Raise(&order_pb.OrderCancelled{...})
+//	}
+//
+// A Collector is not safe for concurrent use.
+type Collector struct {
+	pending []outbox.OutboxMessage
+}
+
+func (c *Collector) Raise(events ...outbox.OutboxMessage) {
+	c.pending = append(c.pending, events...)
+}
+
+// Events returns the events raised since the last flush.
+func (c *Collector) Events() []outbox.OutboxMessage {
+	return c.pending
+}
+
+// Flush sends the events in one batch, and clears them once sent. If the
+// save transaction then rolls back, the aggregate should be reloaded
+// rather than flushed again.
+func (c *Collector) Flush(ctx context.Context, tx sqrlx.Transaction, sender BatchSender) error {
+	return Flush(ctx, tx, sender, c)
+}
+
+// Flush sends the events of several collectors, e.g. every aggregate saved
+// in the transaction, in one batch.
+func Flush(ctx context.Context, tx sqrlx.Transaction, sender BatchSender, collectors ...*Collector) error {
+	all := []outbox.OutboxMessage{}
+	for _, collector := range collectors {
+		all = append(all, collector.pending...)
+	}
+	if len(all) == 0 {
+		return nil
+	}
+	if err := sender.SendBatch(ctx, tx, all...); err != nil {
+		return err
+	}
+	for _, collector := range collectors {
+		collector.pending = nil
+	}
+	return nil
+}
@@ -0,0 +1,483 @@
+package outbox
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"slices"
+	"sort"
+	"time"
+
+	sq "github.com/elgris/sqrl"
+	"github.com/google/uuid"
+	"github.com/pentops/sqrlx.go/sqrlx"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// ExportRecord is one line of the JSONL export format.
+type ExportRecord struct {
+	ID          string     `json:"id,omitempty"`
+	Destination string     `json:"destination"`
+	Headers     url.Values `json:"headers"`
+	Message     []byte     `json:"message"`
+
+	// The optional columns, when the sender has them and they are set
+	AggregateType     string `json:"aggregateType,omitempty"`
+	AggregateID       string `json:"aggregateId,omitempty"`
+	AggregateSequence uint64 `json:"aggregateSequence,omitempty"`
+	Region            string `json:"region,omitempty"`
+	CompactionKey     string `json:"compactionKey,omitempty"`
+	Priority          int32  `json:"priority,omitempty"`
+
+	// RFC3339Nano in UTC, when the sender has a CreatedAtColumn, and
+	// written back by Import
+	CreatedAt string `json:"createdAt,omitempty"`
+
+	// RFC3339Nano in UTC, for a message acked while the sender has a
+	// DeliveredAtColumn
+	DeliveredAt string `json:"deliveredAt,omitempty"`
+
+	// Read from, and imported back to, the ArchiveTable
+	Archived bool `json:"archived,omitempty"`
+
+	// Canonical JSON of the decoded message, see ExportOptions.Decode.
+	// Ignored by Import.
+	JSON json.RawMessage `json:"json,omitempty"`
+}
+
+// ExportOptions make an export deterministic, so the same outbox contents
+// serialize identically across machines, e.g. for golden files. Headers
+// are always written with sorted keys.
+type ExportOptions struct {
+	// Leaves out IDs, which are random unless the sender has an IDNamespace
+	OmitIDs bool
+
+	// Leaves out CreatedAt, which is otherwise written in UTC
+	OmitCreatedAt bool
+
+	// Orders records by destination, headers and body rather than by ID.
+	// Records are held in memory to sort them.
+	SortByContent bool
+
+	// Optional, decodes the payload to add the JSON field, written with
+	// protojson and then re-encoded with sorted keys and no whitespace
+	Decode func(destination string, data []byte) (proto.Message, error)
+}
+
+// Export writes every message in the outbox table to w as JSONL, ordered by
+// ID, without removing them, including delivered messages, followed by the
+// ArchiveTable when the sender has one. Records are written as they are
+// read.
+func (ss *NamedSender) Export(ctx context.Context, tx sqrlx.Transaction, w io.Writer) error {
+	return ss.ExportWith(ctx, tx, w, ExportOptions{})
+}
+
+// ExportWith is Export with canonicalization options.
+func (ss *NamedSender) ExportWith(ctx context.Context, tx sqrlx.Transaction, w io.Writer, opts ExportOptions) error {
+	encoder := json.NewEncoder(w)
+	if !opts.SortByContent {
+		return ss.exportEach(ctx, tx, opts, func(record ExportRecord) error {
+			return encoder.Encode(record)
+		})
+	}
+
+	records := []ExportRecord{}
+	if err := ss.exportEach(ctx, tx, opts, func(record ExportRecord) error {
+		records = append(records, record)
+		return nil
+	}); err != nil {
+		return err
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		if a.Destination != b.Destination {
+			return a.Destination < b.Destination
+		}
+		if aHeaders, bHeaders := a.Headers.Encode(), b.Headers.Encode(); aHeaders != bHeaders {
+			return aHeaders < bHeaders
+		}
+		return bytes.Compare(a.Message, b.Message) < 0
+	})
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportEach reads the outbox table and then the ArchiveTable.
+func (ss *NamedSender) exportEach(ctx context.Context, tx sqrlx.Transaction, opts ExportOptions, callback func(ExportRecord) error) error {
+	if err := ss.exportTable(ctx, tx, ss.TableName, false, opts, callback); err != nil {
+		return err
+	}
+	if ss.ArchiveTable == "" {
+		return nil
+	}
+	return ss.exportTable(ctx, tx, ss.ArchiveTable, true, opts, callback)
+}
+
+// exportTable reads every configured column of the messages in table,
+// ordered by ID.
+func (ss *NamedSender) exportTable(ctx context.Context, tx sqrlx.Transaction, table string, archived bool, opts ExportOptions, callback func(ExportRecord) error) error {
+	var headers string
+	var aggregateType, aggregateID, region, compactionKey sql.NullString
+	var aggregateSequence sql.NullInt64
+	var priority sql.NullInt32
+	var createdAt, deliveredAt sql.NullTime
+	record := ExportRecord{}
+
+	columns := []string{ss.IDColumn, ss.DestinationColumn, ss.HeadersColumn, ss.DataColumn}
+	into := []interface{}{&record.ID, &record.Destination, &headers, &record.Message}
+	for _, optional := range []struct {
+		column string
+		into   interface{}
+	}{
+		{ss.AggregateTypeColumn, &aggregateType},
+		{ss.AggregateIDColumn, &aggregateID},
+		{ss.AggregateSequenceColumn, &aggregateSequence},
+		{ss.RegionColumn, &region},
+		{ss.CompactionKeyColumn, &compactionKey},
+		{ss.PriorityColumn, &priority},
+		{ss.CreatedAtColumn, &createdAt},
+		{ss.DeliveredAtColumn, &deliveredAt},
+	} {
+		if optional.column != "" {
+			columns = append(columns, optional.column)
+			into = append(into, optional.into)
+		}
+	}
+
+	rows, err := tx.Select(ctx, sq.Select(columns...).
+		From(table).
+		OrderBy(ss.IDColumn))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		record = ExportRecord{}
+		if err := rows.Scan(into...); err != nil {
+			return err
+		}
+		record.Headers, err = DecodeHeaders(headers)
+		if err != nil {
+			return fmt.Errorf("message %s: %w", record.ID, err)
+		}
+		record.AggregateType = aggregateType.String
+		record.AggregateID = aggregateID.String
+		record.AggregateSequence = uint64(aggregateSequence.Int64)
+		record.Region = region.String
+		record.CompactionKey = compactionKey.String
+		record.Priority = priority.Int32
+		if createdAt.Valid && !opts.OmitCreatedAt {
+			record.CreatedAt = createdAt.Time.UTC().Format(time.RFC3339Nano)
+		}
+		if deliveredAt.Valid {
+			record.DeliveredAt = deliveredAt.Time.UTC().Format(time.RFC3339Nano)
+		}
+		record.Archived = archived
+		if opts.Decode != nil {
+			record.JSON, err = canonicalJSON(opts.Decode, record.Destination, record.Message)
+			if err != nil {
+				return fmt.Errorf("message %s: %w", record.ID, err)
+			}
+		}
+		if opts.OmitIDs {
+			record.ID = ""
+		}
+		if err := callback(record); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// canonicalJSON round trips protojson, whose whitespace is deliberately
+// unstable, through encoding/json, which sorts object keys.
+func canonicalJSON(decode func(string, []byte) (proto.Message, error), destination string, data []byte) (json.RawMessage, error) {
+	msg, err := decode(destination, data)
+	if err != nil {
+		return nil, err
+	}
+	protoJSON, err := protojson.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	// UseNumber keeps numbers exactly as protojson wrote them
+	decoder := json.NewDecoder(bytes.NewReader(protoJSON))
+	decoder.UseNumber()
+	var generic interface{}
+	if err := decoder.Decode(&generic); err != nil {
+		return nil, err
+	}
+	return json.Marshal(generic)
+}
+
+// Import inserts every message from a JSONL export, keeping the IDs, so
+// importing the same export twice fails on the primary key. Lines are read
+// as they are inserted, importBatchSize messages per statement. Imported
+// aggregate sequences raise the SequenceTable, when set, so later sends
+// carry on from them.
+func (ss *NamedSender) Import(ctx context.Context, tx sqrlx.Transaction, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+	batch := &importBatch{}
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		record := ExportRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		table, values, err := ss.importValues(record)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		columns := sortedColumns(values)
+		if !batch.fits(table, columns) {
+			if err := ss.importFlush(ctx, tx, batch); err != nil {
+				return err
+			}
+			batch = &importBatch{table: table, columns: columns, sequences: map[aggregateKey]uint64{}}
+		}
+		batch.add(line, record, values)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return ss.importFlush(ctx, tx, batch)
+}
+
+const importBatchSize = 500
+
+// importBatch is consecutive lines for one table with the same columns,
+// inserted in one statement.
+type importBatch struct {
+	table     string
+	columns   []string
+	rows      [][]interface{}
+	firstLine int
+	lastLine  int
+	sequences map[aggregateKey]uint64
+}
+
+func (batch *importBatch) fits(table string, columns []string) bool {
+	return len(batch.rows) > 0 && len(batch.rows) < importBatchSize &&
+		batch.table == table && slices.Equal(batch.columns, columns)
+}
+
+func (batch *importBatch) add(line int, record ExportRecord, values map[string]interface{}) {
+	row := make([]interface{}, 0, len(batch.columns))
+	for _, column := range batch.columns {
+		row = append(row, values[column])
+	}
+	if len(batch.rows) == 0 {
+		batch.firstLine = line
+	}
+	batch.lastLine = line
+	batch.rows = append(batch.rows, row)
+	if sequence := record.AggregateSequence; sequence > 0 {
+		key := aggregateKey{aggregateType: record.AggregateType, aggregateID: record.AggregateID}
+		if sequence > batch.sequences[key] {
+			batch.sequences[key] = sequence
+		}
+	}
+}
+
+func (ss *NamedSender) importFlush(ctx context.Context, tx sqrlx.Transaction, batch *importBatch) error {
+	if len(batch.rows) == 0 {
+		return nil
+	}
+	insert := sq.Insert(batch.table).Columns(batch.columns...)
+	for _, row := range batch.rows {
+		insert = insert.Values(row...)
+	}
+	if _, err := tx.Insert(ctx, insert); err != nil {
+		return fmt.Errorf("lines %d-%d: %w", batch.firstLine, batch.lastLine, err)
+	}
+	if ss.SequenceTable == "" {
+		return nil
+	}
+	for key, sequence := range batch.sequences {
+		if _, err := tx.Exec(ctx, sq.Expr(
+			"INSERT INTO "+ss.SequenceTable+" (aggregate_type, aggregate_id, sequence) VALUES (?, ?, ?)"+
+				" ON CONFLICT (aggregate_type, aggregate_id) DO UPDATE SET sequence = greatest("+ss.SequenceTable+".sequence, EXCLUDED.sequence)",
+			key.aggregateType, key.aggregateID, sequence,
+		)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortedColumns(values map[string]interface{}) []string {
+	columns := make([]string, 0, len(values))
+	for column := range values {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	return columns
+}
+
+// importValues returns the table the record is inserted to, and its values
+// by column.
+func (ss *NamedSender) importValues(record ExportRecord) (string, map[string]interface{}, error) {
+	table := ss.TableName
+	if record.Archived {
+		if ss.ArchiveTable == "" {
+			return "", nil, fmt.Errorf("%w: message %s is archived, the sender has no ArchiveTable", ErrUnsupportedSender, record.ID)
+		}
+		table = ss.ArchiveTable
+	}
+
+	id := record.ID
+	if id == "" {
+		// exported with OmitIDs
+		id = uuid.NewString()
+	}
+	values := map[string]interface{}{
+		ss.IDColumn:          id,
+		ss.DestinationColumn: record.Destination,
+		ss.HeadersColumn:     ss.HeaderEncoding.Encode(record.Headers),
+		ss.DataColumn:        record.Message,
+	}
+	if ss.AggregateTypeColumn != "" {
+		values[ss.AggregateTypeColumn] = nullString(record.AggregateType)
+	}
+	if ss.AggregateIDColumn != "" {
+		values[ss.AggregateIDColumn] = nullString(record.AggregateID)
+	}
+	if ss.AggregateSequenceColumn != "" {
+		var sequence interface{}
+		if record.AggregateSequence != 0 {
+			sequence = record.AggregateSequence
+		}
+		values[ss.AggregateSequenceColumn] = sequence
+	}
+	if ss.RegionColumn != "" {
+		values[ss.RegionColumn] = nullString(record.Region)
+	}
+	if ss.CompactionKeyColumn != "" {
+		values[ss.CompactionKeyColumn] = nullString(record.CompactionKey)
+	}
+	if ss.PriorityColumn != "" {
+		values[ss.PriorityColumn] = record.Priority
+	}
+	// without a createdAt, e.g. exported with OmitCreatedAt, the column's
+	// default applies
+	if ss.CreatedAtColumn != "" && record.CreatedAt != "" {
+		createdAt, err := time.Parse(time.RFC3339Nano, record.CreatedAt)
+		if err != nil {
+			return "", nil, fmt.Errorf("createdAt: %w", err)
+		}
+		values[ss.CreatedAtColumn] = createdAt
+	}
+	if record.DeliveredAt != "" {
+		if ss.DeliveredAtColumn == "" {
+			if !record.Archived {
+				// it would be delivered again
+				return "", nil, fmt.Errorf("%w: message %s was delivered, the sender has no DeliveredAtColumn", ErrUnsupportedSender, record.ID)
+			}
+		} else {
+			deliveredAt, err := time.Parse(time.RFC3339Nano, record.DeliveredAt)
+			if err != nil {
+				return "", nil, fmt.Errorf("deliveredAt: %w", err)
+			}
+			values[ss.DeliveredAtColumn] = deliveredAt
+		}
+	}
+	return table, values, nil
+}
+
+// nullString stores an empty value as NULL, as the send path does.
+func nullString(value string) interface{} {
+	if value == "" {
+		return nil
+	}
+	return value
+}
+
+func defaultNamedSender() (*NamedSender, error) {
+	sender, ok := DefaultSender.(*NamedSender)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T does not use an outbox table", ErrUnsupportedSender, DefaultSender)
+	}
+	return sender, nil
+}
+
+// Export writes the contents of the DefaultSender's tables from a consistent
+// snapshot, as they are read.
+func Export(ctx context.Context, conn sqrlx.Connection, w io.Writer) error {
+	sender, err := defaultNamedSender()
+	if err != nil {
+		return err
+	}
+	db, err := sqrlx.New(conn, sq.Dollar)
+	if err != nil {
+		return err
+	}
+	// the transaction is retried when the commit fails, which for a
+	// read-only snapshot doesn't invalidate what was read, so a second
+	// attempt has nothing to write
+	started, written := false, false
+	return db.Transact(ctx, &sqrlx.TxOptions{
+		ReadOnly:  true,
+		Isolation: sql.LevelRepeatableRead,
+	}, func(ctx context.Context, tx sqrlx.Transaction) error {
+		if written {
+			return nil
+		}
+		if started {
+			return errExportRetried
+		}
+		started = true
+		if err := sender.ExportWith(ctx, tx, w, ExportOptions{}); err != nil {
+			return err
+		}
+		written = true
+		return nil
+	})
+}
+
+// Import loads an export into the DefaultSender's tables in one transaction,
+// reading it as it is inserted. The reader can only be read once, so the
+// transaction isn't retried once it has started reading.
+func Import(ctx context.Context, conn sqrlx.Connection, r io.Reader) error {
+	sender, err := defaultNamedSender()
+	if err != nil {
+		return err
+	}
+	db, err := sqrlx.New(conn, sq.Dollar)
+	if err != nil {
+		return err
+	}
+	started := false
+	return db.Transact(ctx, &sqrlx.TxOptions{
+		ReadOnly:  false,
+		Isolation: sql.LevelReadCommitted,
+	}, func(ctx context.Context, tx sqrlx.Transaction) error {
+		if started {
+			return errImportRetried
+		}
+		started = true
+		return sender.Import(ctx, tx, r)
+	})
+}
+
+var (
+	errExportRetried = errors.New("outbox: export failed after writing part of it, export it again")
+	errImportRetried = errors.New("outbox: import transaction failed after reading the export, import it again")
+)
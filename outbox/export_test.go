@@ -0,0 +1,325 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	sq "github.com/elgris/sqrl"
+	"github.com/lib/pq"
+	"github.com/pentops/outbox.pg.go/internal/fakedb"
+	"github.com/pentops/sqrlx.go/sqrlx"
+)
+
+func exportSender() *NamedSender {
+	sender := NewNamedSender(DefaultConfig())
+	sender.AggregateTypeColumn = "aggregate_type"
+	sender.AggregateIDColumn = "aggregate_id"
+	sender.AggregateSequenceColumn = "aggregate_sequence"
+	sender.RegionColumn = "region"
+	sender.CompactionKeyColumn = "compaction_key"
+	sender.PriorityColumn = "priority"
+	sender.CreatedAtColumn = "created_at"
+	sender.DeliveredAtColumn = "delivered_at"
+	return sender
+}
+
+var (
+	exportCreatedAt   = time.Date(2024, 5, 1, 12, 30, 0, 123456789, time.UTC)
+	exportDeliveredAt = time.Date(2024, 5, 1, 12, 31, 0, 0, time.UTC)
+)
+
+// exportedRows answers the export's SELECT with one message using every
+// column, failing the first COMMIT so that the transaction is retried.
+func exportedRows() fakedb.Handler {
+	committed := false
+	return func(query string, args []driver.NamedValue) (*fakedb.Result, error) {
+		switch {
+		case strings.HasPrefix(query, "SELECT"):
+			return &fakedb.Result{
+				Columns: []string{"id", "destination", "headers", "message", "aggregate_type", "aggregate_id", "aggregate_sequence", "region", "compaction_key", "priority", "created_at", "delivered_at"},
+				Rows: [][]driver.Value{{
+					"msg-1", "test.v1.Topic", "compaction-key=k1&region=eu", []byte("body"),
+					"order", "o-1", int64(7), "eu", "k1", int64(3), exportCreatedAt, exportDeliveredAt,
+				}},
+			}, nil
+		case query == "COMMIT" && !committed:
+			committed = true
+			return nil, &pq.Error{Code: "40001", Message: "injected"}
+		}
+		return &fakedb.Result{RowsAffected: 1}, nil
+	}
+}
+
+func withDefaultSender(t *testing.T, sender Sender) {
+	previous := DefaultSender
+	DefaultSender = sender
+	t.Cleanup(func() { DefaultSender = previous })
+}
+
+func TestExportCoversColumnsAndWritesOnce(t *testing.T) {
+	withDefaultSender(t, exportSender())
+	db := fakedb.Open(exportedRows())
+
+	out := &bytes.Buffer{}
+	if err := Export(context.Background(), db.DB, out); err != nil {
+		t.Fatal(err)
+	}
+
+	if begins := countStatements(db.Statements(), "BEGIN"); begins != 2 {
+		t.Fatalf("got %d transactions, want the export retried once", begins)
+	}
+	if selects := countStatements(db.Statements(), "SELECT"); selects != 1 {
+		t.Errorf("got %d reads, want the retry to have nothing to read", selects)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("got %d lines from a retried export, want 1:\n%s", len(lines), out)
+	}
+	record := ExportRecord{}
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+	want := ExportRecord{
+		ID:                "msg-1",
+		Destination:       "test.v1.Topic",
+		Message:           []byte("body"),
+		AggregateType:     "order",
+		AggregateID:       "o-1",
+		AggregateSequence: 7,
+		Region:            "eu",
+		CompactionKey:     "k1",
+		Priority:          3,
+		CreatedAt:         "2024-05-01T12:30:00.123456789Z",
+		DeliveredAt:       "2024-05-01T12:31:00Z",
+	}
+	record.Headers = nil
+	if got, _ := json.Marshal(record); string(got) != mustJSON(t, want) {
+		t.Errorf("got %s\nwant %s", got, mustJSON(t, want))
+	}
+}
+
+func countStatements(statements []string, prefix string) int {
+	count := 0
+	for _, statement := range statements {
+		if strings.HasPrefix(statement, prefix) {
+			count++
+		}
+	}
+	return count
+}
+
+func mustJSON(t *testing.T, value interface{}) string {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(encoded)
+}
+
+func TestExportIncludesArchive(t *testing.T) {
+	sender := NewNamedSender(DefaultConfig())
+	sender.ArchiveTable = "outbox_archive"
+	db := fakedb.Open(func(query string, args []driver.NamedValue) (*fakedb.Result, error) {
+		if !strings.HasPrefix(query, "SELECT") {
+			return &fakedb.Result{}, nil
+		}
+		id := "pending"
+		if strings.Contains(query, "FROM outbox_archive") {
+			id = "archived"
+		}
+		return &fakedb.Result{
+			Columns: []string{"id", "destination", "headers", "message"},
+			Rows:    [][]driver.Value{{id, "test.v1.Topic", "", []byte("body")}},
+		}, nil
+	})
+
+	out := &bytes.Buffer{}
+	exportTx(t, db, func(ctx context.Context, tx sqrlx.Transaction) error {
+		return sender.Export(ctx, tx, out)
+	})
+
+	got := []string{}
+	decoder := json.NewDecoder(out)
+	for decoder.More() {
+		record := ExportRecord{}
+		if err := decoder.Decode(&record); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%s archived=%v", record.ID, record.Archived))
+	}
+	if want := []string{"pending archived=false", "archived archived=true"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func exportTx(t *testing.T, db *fakedb.DB, cb func(context.Context, sqrlx.Transaction) error) {
+	t.Helper()
+	wrapper, err := sqrlx.New(db.DB, sq.Dollar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wrapper.Transact(context.Background(), &sqrlx.TxOptions{
+		Isolation: sql.LevelReadCommitted,
+	}, cb); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestImportBatchesLines(t *testing.T) {
+	sender := NewNamedSender(DefaultConfig())
+	sender.ArchiveTable = "outbox_archive"
+	sender.DeliveredAtColumn = "delivered_at"
+	var inserts []string
+	db := fakedb.Open(func(query string, args []driver.NamedValue) (*fakedb.Result, error) {
+		if strings.HasPrefix(query, "INSERT") {
+			inserts = append(inserts, fmt.Sprintf("%s (%d args)", query, len(args)))
+		}
+		return &fakedb.Result{RowsAffected: 1}, nil
+	})
+
+	export := &strings.Builder{}
+	for i := 0; i < importBatchSize+1; i++ {
+		fmt.Fprintf(export, `{"id":"msg-%d","destination":"test.v1.Topic","headers":{},"message":"Ym9keQ=="}`+"\n", i)
+	}
+	export.WriteString(`{"id":"acked","destination":"test.v1.Topic","headers":{},"message":"Ym9keQ==","deliveredAt":"2024-05-01T12:31:00Z"}` + "\n")
+	export.WriteString(`{"id":"archived","destination":"test.v1.Topic","headers":{},"message":"Ym9keQ==","deliveredAt":"2024-05-01T12:31:00Z","archived":true}` + "\n")
+
+	exportTx(t, db, func(ctx context.Context, tx sqrlx.Transaction) error {
+		return sender.Import(ctx, tx, strings.NewReader(export.String()))
+	})
+
+	want := []string{
+		fmt.Sprintf("INSERT INTO outbox (destination,headers,id,message) VALUES %s (%d args)", placeholders(importBatchSize, 4), importBatchSize*4),
+		"INSERT INTO outbox (destination,headers,id,message) VALUES ($1,$2,$3,$4) (4 args)",
+		"INSERT INTO outbox (delivered_at,destination,headers,id,message) VALUES ($1,$2,$3,$4,$5) (5 args)",
+		"INSERT INTO outbox_archive (delivered_at,destination,headers,id,message) VALUES ($1,$2,$3,$4,$5) (5 args)",
+	}
+	if !reflect.DeepEqual(inserts, want) {
+		t.Errorf("got inserts\n%s\nwant\n%s", strings.Join(inserts, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func placeholders(rows int, columns int) string {
+	groups := make([]string, 0, rows)
+	for row := 0; row < rows; row++ {
+		group := make([]string, 0, columns)
+		for column := 0; column < columns; column++ {
+			group = append(group, fmt.Sprintf("$%d", row*columns+column+1))
+		}
+		groups = append(groups, "("+strings.Join(group, ",")+")")
+	}
+	return strings.Join(groups, ",")
+}
+
+func TestImportRefusesDeliveredWithoutColumn(t *testing.T) {
+	sender := NewNamedSender(DefaultConfig())
+	if _, _, err := sender.importValues(ExportRecord{ID: "acked", Destination: "test.v1.Topic", DeliveredAt: "2024-05-01T12:31:00Z"}); !errors.Is(err, ErrUnsupportedSender) {
+		t.Errorf("got %v importing a delivered message as pending", err)
+	}
+	if _, _, err := sender.importValues(ExportRecord{ID: "archived", Destination: "test.v1.Topic", Archived: true}); !errors.Is(err, ErrUnsupportedSender) {
+		t.Errorf("got %v importing an archived message without an ArchiveTable", err)
+	}
+}
+
+func TestImportNotRetriedAfterReading(t *testing.T) {
+	withDefaultSender(t, exportSender())
+	db := fakedb.Open(exportedRows())
+
+	export := `{"id":"msg-1","destination":"test.v1.Topic","headers":{},"message":"Ym9keQ=="}` + "\n" +
+		`{"id":"msg-2","destination":"test.v1.Topic","headers":{},"message":"Ym9keQ=="}` + "\n"
+	if err := Import(context.Background(), db.DB, strings.NewReader(export)); !errors.Is(err, errImportRetried) {
+		t.Fatalf("got %v, want errImportRetried for a failed commit", err)
+	}
+
+	// the reader was consumed by the first attempt, in one statement
+	if inserts := countStatements(db.Statements(), "INSERT"); inserts != 1 {
+		t.Errorf("got %d inserts, want 1", inserts)
+	}
+}
+
+func TestImportValuesCoverColumns(t *testing.T) {
+	sender := exportSender()
+	_, values, err := sender.importValues(ExportRecord{
+		ID:                "msg-1",
+		Destination:       "test.v1.Topic",
+		Message:           []byte("body"),
+		AggregateType:     "order",
+		AggregateID:       "o-1",
+		AggregateSequence: 7,
+		Region:            "eu",
+		CompactionKey:     "k1",
+		Priority:          3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for column, want := range map[string]interface{}{
+		"aggregate_type":     "order",
+		"aggregate_id":       "o-1",
+		"aggregate_sequence": uint64(7),
+		"region":             "eu",
+		"compaction_key":     "k1",
+		"priority":           int32(3),
+	} {
+		if got := values[column]; got != want {
+			t.Errorf("%s: got %#v, want %#v", column, got, want)
+		}
+	}
+
+	_, empty, err := sender.importValues(ExportRecord{ID: "msg-2", Destination: "test.v1.Topic"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, column := range []string{"aggregate_type", "aggregate_id", "aggregate_sequence", "region", "compaction_key"} {
+		if got := empty[column]; got != nil {
+			t.Errorf("%s: got %#v, want NULL", column, got)
+		}
+	}
+}
+
+func TestImportValuesCreatedAt(t *testing.T) {
+	sender := exportSender()
+	for _, tc := range []struct {
+		name      string
+		createdAt string
+		want      interface{}
+		wantErr   bool
+	}{
+		{name: "exported", createdAt: "2024-05-01T12:30:00.123456789Z", want: exportCreatedAt},
+		{name: "offset", createdAt: "2024-05-01T14:30:00.123456789+02:00", want: exportCreatedAt},
+		{name: "omitted, defaults", createdAt: "", want: nil},
+		{name: "malformed", createdAt: "yesterday", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, values, err := sender.importValues(ExportRecord{ID: "msg-1", Destination: "test.v1.Topic", CreatedAt: tc.createdAt})
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, ok := values["created_at"]
+			if tc.want == nil {
+				if ok {
+					t.Errorf("got %v, want the column left to its default", got)
+				}
+				return
+			}
+			if createdAt, _ := got.(time.Time); !createdAt.Equal(tc.want.(time.Time)) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
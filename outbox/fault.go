@@ -0,0 +1,54 @@
+package outbox
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// FaultInjector wraps a publish function, e.g. for an InlineDeliverer or a
+// relay built on ClaimEach, failing or slowing a share of publishes so
+// that staging continuously exercises retry paths and alerting.
+type FaultInjector struct {
+	// Share of publishes which fail, from 0 to 1
+	FailureRate float64
+
+	// Added before each publish, plus up to Jitter more
+	Latency time.Duration
+	Jitter  time.Duration
+
+	// Returned by failed publishes, defaults to ErrInjectedFault
+	Err error
+}
+
+func (fi *FaultInjector) Wrap(publish PublishFunc) PublishFunc {
+	return func(ctx context.Context, delivery *Delivery) error {
+		delay := fi.Latency
+		if fi.Jitter > 0 {
+			delay += time.Duration(rand.Int63n(int64(fi.Jitter)))
+		}
+		if delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C:
+			}
+		}
+
+		if fi.FailureRate > 0 && rand.Float64() < fi.FailureRate {
+			err := fi.Err
+			if err == nil {
+				err = ErrInjectedFault
+			}
+			return &DeliveryError{
+				MessageID:   delivery.ID,
+				Destination: delivery.Destination,
+				Retryable:   true,
+				Err:         err,
+			}
+		}
+		return publish(ctx, delivery)
+	}
+}
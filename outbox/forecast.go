@@ -0,0 +1,144 @@
+package outbox
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pentops/sqrlx.go/sqrlx"
+)
+
+// StatsSampler keeps periodic Stats samples to estimate how backlogs are
+// changing. Rates are net, enqueued less drained, between the oldest and
+// newest samples: the table alone can't tell the two apart.
+type StatsSampler struct {
+	sender *NamedSender
+
+	// Samples kept, older ones are dropped
+	MaxSamples int
+
+	// Optional, updated with each sample
+	Gauge *BacklogGauge
+
+	lock    sync.Mutex
+	samples []statsSample
+}
+
+type statsSample struct {
+	at    time.Time
+	stats map[string]DestinationStats
+}
+
+// Forecast is the trend of one destination's backlog.
+type Forecast struct {
+	Destination string
+	Messages    uint64
+	Bytes       uint64
+
+	// Net change per second, negative while the backlog drains
+	MessageRate float64
+	ByteRate    float64
+
+	// Over the samples used for the rates
+	Window time.Duration
+}
+
+func NewStatsSampler(sender *NamedSender) *StatsSampler {
+	return &StatsSampler{
+		sender:     sender,
+		MaxSamples: 60,
+	}
+}
+
+// Sample reads Stats in tx and records them.
+func (sampler *StatsSampler) Sample(ctx context.Context, tx sqrlx.Transaction) error {
+	stats, err := sampler.sender.Stats(ctx, tx)
+	if err != nil {
+		return err
+	}
+	sampler.Record(time.Now(), stats)
+	return nil
+}
+
+// Record adds stats read elsewhere, e.g. by a BacklogGuard, at the time
+// they were read.
+func (sampler *StatsSampler) Record(at time.Time, stats []*DestinationStats) {
+	sample := statsSample{
+		at:    at,
+		stats: make(map[string]DestinationStats, len(stats)),
+	}
+	for _, destStats := range stats {
+		sample.stats[destStats.Destination] = *destStats
+	}
+
+	if sampler.Gauge != nil {
+		sampler.Gauge.Update(stats)
+	}
+
+	sampler.lock.Lock()
+	defer sampler.lock.Unlock()
+	sampler.samples = append(sampler.samples, sample)
+	if sampler.MaxSamples > 0 && len(sampler.samples) > sampler.MaxSamples {
+		sampler.samples = sampler.samples[len(sampler.samples)-sampler.MaxSamples:]
+	}
+}
+
+// Forecast returns the destination's trend, or false until there are two
+// samples. A destination missing from a sample had no messages.
+func (sampler *StatsSampler) Forecast(destination string) (*Forecast, bool) {
+	sampler.lock.Lock()
+	defer sampler.lock.Unlock()
+
+	if len(sampler.samples) < 2 {
+		return nil, false
+	}
+	oldest := sampler.samples[0]
+	newest := sampler.samples[len(sampler.samples)-1]
+	window := newest.at.Sub(oldest.at)
+	if window <= 0 {
+		return nil, false
+	}
+
+	from, to := oldest.stats[destination], newest.stats[destination]
+	seconds := window.Seconds()
+	return &Forecast{
+		Destination: destination,
+		Messages:    to.Messages,
+		Bytes:       to.Bytes,
+		MessageRate: (float64(to.Messages) - float64(from.Messages)) / seconds,
+		ByteRate:    (float64(to.Bytes) - float64(from.Bytes)) / seconds,
+		Window:      window,
+	}, true
+}
+
+// TimeToEmpty projects when the backlog clears at the current rate, false
+// when it isn't draining.
+func (forecast *Forecast) TimeToEmpty() (time.Duration, bool) {
+	if forecast.Messages == 0 {
+		return 0, true
+	}
+	if forecast.MessageRate >= 0 {
+		return 0, false
+	}
+	return secondsDuration(float64(forecast.Messages) / -forecast.MessageRate), true
+}
+
+// TimeToBytes projects when the backlog reaches limit bytes, e.g. a
+// BacklogGuard quota or the free disk space, false when it isn't growing.
+func (forecast *Forecast) TimeToBytes(limit uint64) (time.Duration, bool) {
+	if forecast.Bytes >= limit {
+		return 0, true
+	}
+	if forecast.ByteRate <= 0 {
+		return 0, false
+	}
+	return secondsDuration(float64(limit-forecast.Bytes) / forecast.ByteRate), true
+}
+
+func secondsDuration(seconds float64) time.Duration {
+	if seconds >= math.MaxInt64/float64(time.Second) {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
@@ -0,0 +1,266 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pentops/sqrlx.go/sqrlx"
+)
+
+// SendGuard can refuse messages before they are written, returning an
+// error from the send.
+type SendGuard interface {
+	CheckSend(ctx context.Context, raw *Raw) error
+}
+
+// BacklogGuard watches the number of messages and bytes waiting per
+// destination, so that a dead consumer or a runaway producer can't grow the
+// outbox without bound. Counts come from
+// NamedSender.Stats, refreshed in the background at most once per CacheFor.
+// Sends are checked against the last counts read, without waiting for a
+// refresh, except for the first sends after the guard is created. A failed
+// refresh is retried after CacheFor, the last counts read being used until
+// then.
+type BacklogGuard struct {
+	db     sqrlx.Transactor
+	sender *NamedSender
+
+	// Backlog size at which the guard trips, Thresholds overrides it per
+	// destination. Zero disables the check.
+	Threshold  uint64
+	Thresholds map[string]uint64
+
+	// Storage quota in body bytes, ByteQuotas overrides it per destination.
+	// Zero disables the check.
+	ByteQuota  uint64
+	ByteQuotas map[string]uint64
+
+	// Reject fails sends to a tripped destination with ErrBacklogExceeded
+	// or ErrQuotaExceeded, otherwise the send goes ahead after calling
+	// OnExceeded or OnQuotaExceeded.
+	Reject          bool
+	OnExceeded      func(destination string, messages uint64)
+	OnQuotaExceeded func(destination string, bytes uint64)
+
+	CacheFor time.Duration
+
+	lock       sync.Mutex
+	stats      map[string]DestinationStats
+	fetchErr   error
+	fetchedAt  time.Time
+	refreshing chan struct{}
+}
+
+func NewBacklogGuard(db sqrlx.Transactor, sender *NamedSender, threshold uint64) *BacklogGuard {
+	return &BacklogGuard{
+		db:        db,
+		sender:    sender,
+		Threshold: threshold,
+		Reject:    true,
+		CacheFor:  time.Second * 10,
+	}
+}
+
+func (bg *BacklogGuard) threshold(destination string) uint64 {
+	if threshold, ok := bg.Thresholds[destination]; ok {
+		return threshold
+	}
+	return bg.Threshold
+}
+
+func (bg *BacklogGuard) byteQuota(destination string) uint64 {
+	if quota, ok := bg.ByteQuotas[destination]; ok {
+		return quota
+	}
+	return bg.ByteQuota
+}
+
+func (bg *BacklogGuard) backlog(ctx context.Context, destination string) (DestinationStats, error) {
+	bg.lock.Lock()
+	fetched := !bg.fetchedAt.IsZero()
+	if !fetched || time.Since(bg.fetchedAt) >= bg.CacheFor {
+		bg.startRefresh(ctx)
+	}
+	if fetched {
+		defer bg.lock.Unlock()
+		return bg.cached(destination)
+	}
+	refreshing := bg.refreshing
+	bg.lock.Unlock()
+
+	// nothing read yet, so wait for the first refresh
+	select {
+	case <-refreshing:
+	case <-ctx.Done():
+		return DestinationStats{}, ctx.Err()
+	}
+	bg.lock.Lock()
+	defer bg.lock.Unlock()
+	return bg.cached(destination)
+}
+
+func (bg *BacklogGuard) cached(destination string) (DestinationStats, error) {
+	if bg.stats == nil {
+		return DestinationStats{}, fmt.Errorf("outbox: reading backlog: %w", bg.fetchErr)
+	}
+	return bg.stats[destination], nil
+}
+
+// startRefresh reads the stats in their own transaction, unless a refresh
+// is already running, so that sends neither queue behind the read nor hold
+// a second connection each. Called with the lock held.
+func (bg *BacklogGuard) startRefresh(ctx context.Context) {
+	if bg.refreshing != nil {
+		return
+	}
+	done := make(chan struct{})
+	bg.refreshing = done
+	// the read outlives the send which started it
+	ctx = context.WithoutCancel(ctx)
+
+	go func() {
+		defer close(done)
+		var stats []*DestinationStats
+		err := bg.db.Transact(ctx, &sqrlx.TxOptions{
+			ReadOnly:  true,
+			Isolation: sql.LevelReadCommitted,
+		}, func(ctx context.Context, tx sqrlx.Transaction) error {
+			var err error
+			stats, err = bg.sender.Stats(ctx, tx)
+			return err
+		})
+
+		bg.lock.Lock()
+		defer bg.lock.Unlock()
+		bg.refreshing = nil
+		// a failure is cached as well, so it isn't retried by every send
+		bg.fetchedAt = time.Now()
+		bg.fetchErr = err
+		if err != nil {
+			return
+		}
+		bg.stats = make(map[string]DestinationStats, len(stats))
+		for _, destStats := range stats {
+			bg.stats[destStats.Destination] = *destStats
+		}
+	}()
+}
+
+func (bg *BacklogGuard) CheckSend(ctx context.Context, raw *Raw) error {
+	threshold := bg.threshold(raw.Destination)
+	quota := bg.byteQuota(raw.Destination)
+	if threshold == 0 && quota == 0 {
+		return nil
+	}
+
+	backlog, err := bg.backlog(ctx, raw.Destination)
+	if err != nil {
+		return err
+	}
+
+	if threshold != 0 && backlog.Messages >= threshold {
+		if bg.OnExceeded != nil {
+			bg.OnExceeded(raw.Destination, backlog.Messages)
+		}
+		if bg.Reject {
+			return fmt.Errorf("%w: %d messages waiting for %s", ErrBacklogExceeded, backlog.Messages, raw.Destination)
+		}
+	}
+
+	if quota != 0 && backlog.Bytes+uint64(len(raw.Body)) > quota {
+		if bg.OnQuotaExceeded != nil {
+			bg.OnQuotaExceeded(raw.Destination, backlog.Bytes)
+		}
+		if bg.Reject {
+			return fmt.Errorf("%w: %d bytes waiting for %s, the quota is %d", ErrQuotaExceeded, backlog.Bytes, raw.Destination, quota)
+		}
+	}
+	return nil
+}
+
+// BacklogGauge holds the latest backlog per destination, shared between
+// whatever measures it, e.g. a StatsSampler or a relay, and the
+// BackpressureGuard of each sender.
+type BacklogGauge struct {
+	lock    sync.RWMutex
+	backlog map[string]uint64
+}
+
+func NewBacklogGauge() *BacklogGauge {
+	return &BacklogGauge{
+		backlog: map[string]uint64{},
+	}
+}
+
+func (gauge *BacklogGauge) Set(destination string, messages uint64) {
+	gauge.lock.Lock()
+	defer gauge.lock.Unlock()
+	gauge.backlog[destination] = messages
+}
+
+// Update replaces the whole gauge, destinations missing from stats have
+// no backlog.
+func (gauge *BacklogGauge) Update(stats []*DestinationStats) {
+	backlog := make(map[string]uint64, len(stats))
+	for _, destStats := range stats {
+		backlog[destStats.Destination] = destStats.Messages
+	}
+	gauge.lock.Lock()
+	defer gauge.lock.Unlock()
+	gauge.backlog = backlog
+}
+
+func (gauge *BacklogGauge) Get(destination string) uint64 {
+	gauge.lock.RLock()
+	defer gauge.lock.RUnlock()
+	return gauge.backlog[destination]
+}
+
+// BackpressureGuard refuses or reports sends to destinations which the
+// gauge shows as backlogged. Unlike a BacklogGuard it never queries the
+// database, so it is cheap enough for every send.
+type BackpressureGuard struct {
+	Gauge *BacklogGauge
+
+	// Backlog at which the guard trips, Thresholds overrides it per
+	// destination. Zero disables the check.
+	Threshold  uint64
+	Thresholds map[string]uint64
+
+	// Reject fails sends to a tripped destination with ErrBackpressure,
+	// otherwise the send goes ahead after calling OnBackpressure.
+	Reject         bool
+	OnBackpressure func(destination string, messages uint64)
+}
+
+func NewBackpressureGuard(gauge *BacklogGauge, threshold uint64) *BackpressureGuard {
+	return &BackpressureGuard{
+		Gauge:     gauge,
+		Threshold: threshold,
+		Reject:    true,
+	}
+}
+
+func (bg *BackpressureGuard) CheckSend(ctx context.Context, raw *Raw) error {
+	threshold := bg.Threshold
+	if destThreshold, ok := bg.Thresholds[raw.Destination]; ok {
+		threshold = destThreshold
+	}
+	if threshold == 0 {
+		return nil
+	}
+	messages := bg.Gauge.Get(raw.Destination)
+	if messages < threshold {
+		return nil
+	}
+	if bg.OnBackpressure != nil {
+		bg.OnBackpressure(raw.Destination, messages)
+	}
+	if bg.Reject {
+		return fmt.Errorf("%w: %d messages waiting for %s", ErrBackpressure, messages, raw.Destination)
+	}
+	return nil
+}
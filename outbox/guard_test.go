@@ -0,0 +1,104 @@
+package outbox
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	sq "github.com/elgris/sqrl"
+	"github.com/pentops/outbox.pg.go/internal/fakedb"
+	"github.com/pentops/sqrlx.go/sqrlx"
+)
+
+// statsDB answers the Stats query with next, counting the reads. Each
+// refresh is one transaction.
+func statsDB(t *testing.T, next func(read int) (*fakedb.Result, error)) (*sqrlx.Wrapper, *fakedb.DB) {
+	read := 0
+	conn := fakedb.Open(func(query string, args []driver.NamedValue) (*fakedb.Result, error) {
+		if !strings.HasPrefix(query, "SELECT") {
+			return &fakedb.Result{}, nil
+		}
+		read++
+		return next(read)
+	})
+	db, err := sqrlx.New(conn.DB, sq.Dollar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, conn
+}
+
+func backlogOf(messages int64) *fakedb.Result {
+	return &fakedb.Result{
+		Columns: []string{"destination", "count", "bytes"},
+		Rows:    [][]driver.Value{{"test.v1.Topic", messages, int64(0)}},
+	}
+}
+
+func TestBacklogGuardServesLastSnapshot(t *testing.T) {
+	release := make(chan struct{})
+	blocked := make(chan struct{}, 1)
+	db, conn := statsDB(t, func(read int) (*fakedb.Result, error) {
+		if read > 1 {
+			select {
+			case blocked <- struct{}{}:
+			default:
+			}
+			<-release
+			return backlogOf(0), nil
+		}
+		return backlogOf(10), nil
+	})
+	guard := NewBacklogGuard(db, NewNamedSender(DefaultConfig()), 5)
+	guard.CacheFor = time.Millisecond
+	raw := &Raw{Destination: "test.v1.Topic"}
+
+	if err := guard.CheckSend(context.Background(), raw); !errors.Is(err, ErrBacklogExceeded) {
+		t.Fatalf("got %v from the first read, want ErrBacklogExceeded", err)
+	}
+
+	// the refresh is stuck, sends carry on with the last counts
+	time.Sleep(5 * time.Millisecond)
+	if err := guard.CheckSend(context.Background(), raw); !errors.Is(err, ErrBacklogExceeded) {
+		t.Fatalf("got %v starting a refresh, want the last snapshot", err)
+	}
+	<-blocked
+	for i := 0; i < 3; i++ {
+		if err := guard.CheckSend(context.Background(), raw); !errors.Is(err, ErrBacklogExceeded) {
+			t.Fatalf("got %v while refreshing, want the last snapshot", err)
+		}
+	}
+	if refreshes := countStatements(conn.Statements(), "BEGIN"); refreshes != 2 {
+		t.Errorf("got %d refreshes, want one at a time", refreshes)
+	}
+
+	close(release)
+	deadline := time.Now().Add(5 * time.Second)
+	for guard.CheckSend(context.Background(), raw) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("the refreshed counts were never used")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBacklogGuardCachesFailure(t *testing.T) {
+	failure := errors.New("too many connections")
+	db, conn := statsDB(t, func(int) (*fakedb.Result, error) {
+		return nil, failure
+	})
+	guard := NewBacklogGuard(db, NewNamedSender(DefaultConfig()), 5)
+	raw := &Raw{Destination: "test.v1.Topic"}
+
+	for i := 0; i < 3; i++ {
+		if err := guard.CheckSend(context.Background(), raw); !errors.Is(err, failure) {
+			t.Fatalf("got %v, want the read failure", err)
+		}
+	}
+	if refreshes := countStatements(conn.Statements(), "BEGIN"); refreshes != 1 {
+		t.Errorf("got %d refreshes, want the failure cached for CacheFor", refreshes)
+	}
+}
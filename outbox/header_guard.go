@@ -0,0 +1,73 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// libraryHeaders are set by this package, so always allowed by a
+// HeaderGuard.
+var libraryHeaders = []string{
+	ContentTypeHeader,
+	RegionHeader,
+	MessageVersionHeader,
+	IdempotencyKeyHeader,
+	CompactionKeyHeader,
+	AggregateTypeHeader,
+	AggregateIDHeader,
+	AggregateSequenceHeader,
+	ReplyToHeader,
+	CorrelationIDHeader,
+	GRPCServiceHeader,
+	TagHeader,
+}
+
+// HeaderGuard is a SendGuard which fails sends with header keys outside of
+// the registered set, so that a typo such as grpc-sevice fails the send
+// rather than silently breaking routing downstream. Patterns use path.Match
+// syntax, e.g. x-trace-*. Headers set by this package are always allowed.
+type HeaderGuard struct {
+	Allow []string
+}
+
+func NewHeaderGuard(allow ...string) (*HeaderGuard, error) {
+	for _, pattern := range allow {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("header pattern %q: %w", pattern, err)
+		}
+	}
+	return &HeaderGuard{
+		Allow: allow,
+	}, nil
+}
+
+func (hg *HeaderGuard) allowed(key string) bool {
+	for _, known := range libraryHeaders {
+		if key == known {
+			return true
+		}
+	}
+	for _, pattern := range hg.Allow {
+		if matched, _ := path.Match(pattern, key); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (hg *HeaderGuard) CheckSend(ctx context.Context, raw *Raw) error {
+	unknown := []string{}
+	for key := range raw.Headers {
+		if !hg.allowed(key) {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	sort.Strings(unknown)
+	return fmt.Errorf("%w: %s on %s", ErrUnknownHeader, strings.Join(unknown, ", "), raw.Destination)
+}
@@ -0,0 +1,112 @@
+package outbox
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// HeaderEncoding is the format of the stored headers value. DecodeHeaders
+// reads either, so the encoding of a table can be changed without
+// migrating existing rows.
+type HeaderEncoding int
+
+const (
+	// HeaderEncodingURL is a url.Values query string, the original format.
+	HeaderEncodingURL HeaderEncoding = iota
+
+	// HeaderEncodingJSON is a JSON object of string arrays, e.g.
+	// {"grpc-service":["/foo.v1.Topic/Bar"]}. JSON strings can't hold
+	// invalid UTF-8, so headers with binary keys or values are stored URL
+	// encoded instead.
+	HeaderEncodingJSON
+)
+
+// Encode formats headers for storage.
+func (he HeaderEncoding) Encode(headers url.Values) string {
+	if he != HeaderEncodingJSON || !validUTF8(headers) {
+		return encodeHeaders(headers)
+	}
+	if headers == nil {
+		headers = url.Values{}
+	}
+	// a map of string slices always marshals, with sorted keys
+	encoded, _ := json.Marshal(headers)
+	return string(encoded)
+}
+
+// DecodeHeaders reads a stored headers value in any HeaderEncoding. URL
+// encoded values never start with '{', which is escaped, so the format is
+// unambiguous.
+func DecodeHeaders(stored string) (url.Values, error) {
+	if strings.HasPrefix(stored, "{") {
+		headers := url.Values{}
+		if err := json.Unmarshal([]byte(stored), &headers); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrMalformedHeaders, err)
+		}
+		return headers, nil
+	}
+	headers, err := url.ParseQuery(stored)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrMalformedHeaders, err)
+	}
+	return headers, nil
+}
+
+func validUTF8(headers url.Values) bool {
+	for k, values := range headers {
+		if !utf8.ValidString(k) {
+			return false
+		}
+		for _, v := range values {
+			if !utf8.ValidString(v) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+var headerBufferPool = sync.Pool{
+	New: func() any {
+		return &bytes.Buffer{}
+	},
+}
+
+// encodeHeaders gives the same output as url.Values.Encode, writing into a
+// pooled buffer.
+func encodeHeaders(headers url.Values) string {
+	if len(headers) == 0 {
+		return ""
+	}
+
+	// on the stack for the usual handful of headers
+	var keyArray [8]string
+	keys := keyArray[:0]
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	buf := headerBufferPool.Get().(*bytes.Buffer)
+	defer headerBufferPool.Put(buf)
+	buf.Reset()
+
+	for _, k := range keys {
+		escapedKey := url.QueryEscape(k)
+		for _, v := range headers[k] {
+			if buf.Len() > 0 {
+				buf.WriteByte('&')
+			}
+			buf.WriteString(escapedKey)
+			buf.WriteByte('=')
+			buf.WriteString(url.QueryEscape(v))
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,110 @@
+package outbox
+
+import (
+	"errors"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func FuzzDecodeHeaders(f *testing.F) {
+	for _, seed := range []string{
+		"",
+		"grpc-service=%2Ffoo.v1.Topic%2FBar",
+		"a=1&a=2&b=",
+		"a+b=c+d&%7B=%7D",
+		"bin=%00%FF%C3%28",
+		"%zz",
+		"a=1;b=2",
+		`{}`,
+		`{"grpc-service":["/foo.v1.Topic/Bar"],"a":["1","2"]}`,
+		`{"a":null,"b":[]}`,
+		`{"a":["\ud800"]}`,
+		`{bad`,
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, stored string) {
+		headers, err := DecodeHeaders(stored)
+		if err != nil {
+			if !errors.Is(err, ErrMalformedHeaders) {
+				t.Fatalf("decode error %v is not ErrMalformedHeaders", err)
+			}
+			return
+		}
+
+		// legacy rows were written by url.Values.Encode
+		if !strings.HasPrefix(stored, "{") {
+			legacy, err := url.ParseQuery(stored)
+			if err != nil {
+				t.Fatalf("decoded %q, which url.ParseQuery refuses: %s", stored, err)
+			}
+			if !reflect.DeepEqual(headers, legacy) {
+				t.Fatalf("decoded %q as %v, url.ParseQuery gives %v", stored, headers, legacy)
+			}
+		}
+
+		for _, encoding := range []HeaderEncoding{HeaderEncodingURL, HeaderEncodingJSON} {
+			encoded := encoding.Encode(headers)
+			if encoding == HeaderEncodingURL {
+				if want := headers.Encode(); encoded != want {
+					t.Fatalf("encoded %v as %q, url.Values.Encode gives %q", headers, encoded, want)
+				}
+				if strings.HasPrefix(encoded, "{") {
+					t.Fatalf("URL encoding of %v starts with '{': %q", headers, encoded)
+				}
+			}
+			decoded, err := DecodeHeaders(encoded)
+			if err != nil {
+				t.Fatalf("encoding %d: decoding %q: %s", encoding, encoded, err)
+			}
+			if !sameHeaders(decoded, headers) {
+				t.Fatalf("encoding %d: %v round trips through %q as %v", encoding, headers, encoded, decoded)
+			}
+		}
+	})
+}
+
+// sameHeaders compares headers as url.Values.Get does, a key without values
+// being the same as no key.
+func sameHeaders(a, b url.Values) bool {
+	for _, pair := range [][2]url.Values{{a, b}, {b, a}} {
+		for k, v := range pair[0] {
+			if len(v) == 0 && len(pair[1][k]) == 0 {
+				continue
+			}
+			if !reflect.DeepEqual(v, pair[1][k]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestHeaderEncodingRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		headers url.Values
+	}{
+		{"empty", url.Values{}},
+		{"nil", nil},
+		{"repeated", url.Values{"tracestate": {"a=1", "b=2"}, GRPCServiceHeader: {"/foo.v1.Topic/Bar"}}},
+		{"reserved characters", url.Values{"a b&c=d": {"{}+%;", ""}}},
+		{"binary", url.Values{"bin": {"\x00\xff\xc3\x28"}, "\xfe": {"key"}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, encoding := range []HeaderEncoding{HeaderEncodingURL, HeaderEncodingJSON} {
+				encoded := encoding.Encode(tc.headers)
+				decoded, err := DecodeHeaders(encoded)
+				if err != nil {
+					t.Fatalf("encoding %d: %s", encoding, err)
+				}
+				if !sameHeaders(decoded, tc.headers) {
+					t.Errorf("encoding %d: %v round trips through %q as %v", encoding, tc.headers, encoded, decoded)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,15 @@
+package outbox
+
+import "github.com/google/uuid"
+
+// IdempotencyKeyHeader identifies a message across retries of the
+// transaction which sends it.
+const IdempotencyKeyHeader = "idempotency-key"
+
+// DeterministicID derives a UUIDv5 from the destination and idempotency
+// key. Two sends of the same message then conflict on the outbox primary
+// key, so a transaction which somehow commits twice fails instead of
+// publishing a duplicate.
+func DeterministicID(namespace uuid.UUID, destination string, idempotencyKey string) string {
+	return uuid.NewSHA1(namespace, []byte(destination+"\x00"+idempotencyKey)).String()
+}
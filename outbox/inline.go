@@ -0,0 +1,92 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/pentops/sqrlx.go/sqrlx"
+)
+
+// InlineDeliverer publishes messages straight after the transaction which
+// sent them commits, cutting latency from the relay's poll interval to the
+// publish call. It is best effort: messages which fail to publish, or
+// which a relay has already claimed, are left in the table for the relay.
+type InlineDeliverer struct {
+	db      sqrlx.Transactor
+	sender  *NamedSender
+	publish PublishFunc
+
+	// Optional, called with inline delivery errors, which are otherwise
+	// dropped as the relay will retry the message.
+	OnError func(error)
+}
+
+func NewInlineDeliverer(db sqrlx.Transactor, sender *NamedSender, publish PublishFunc) *InlineDeliverer {
+	return &InlineDeliverer{
+		db:      db,
+		sender:  sender,
+		publish: publish,
+	}
+}
+
+// Transact is BufferedTransact followed by delivery of the messages sent
+// in cb. Its error is the transaction's, delivery only reports to OnError.
+func (d *InlineDeliverer) Transact(ctx context.Context, opts *sqrlx.TxOptions, cb func(context.Context, sqrlx.Transaction, *BufferedSender) error) error {
+	var ids []string
+	if err := d.db.Transact(ctx, opts, func(ctx context.Context, tx sqrlx.Transaction) error {
+		buffered := NewBufferedSender(d.sender)
+		if err := cb(ctx, tx, buffered); err != nil {
+			return err
+		}
+		ids = make([]string, 0, len(buffered.pending))
+		for _, raw := range buffered.pending {
+			ids = append(ids, raw.ID)
+		}
+		return buffered.Flush(ctx, tx)
+	}); err != nil {
+		return err
+	}
+
+	if len(ids) > 0 {
+		if err := d.deliver(ctx, ids); err != nil && d.OnError != nil {
+			d.OnError(err)
+		}
+	}
+	return nil
+}
+
+// deliver claims the committed messages, so that a relay reading at the
+// same time skips them, and acks the ones published. A publish failure is
+// returned once the acks commit, so a retried transaction reports it once.
+func (d *InlineDeliverer) deliver(ctx context.Context, ids []string) error {
+	var publishErr error
+	if err := d.db.Transact(ctx, &sqrlx.TxOptions{
+		ReadOnly:  false,
+		Isolation: sql.LevelReadCommitted,
+	}, func(ctx context.Context, tx sqrlx.Transaction) error {
+		publishErr = nil
+		published := []string{}
+		if err := d.sender.claimEach(ctx, tx, uint64(len(ids)), claimFilter{ids: ids}, func(delivery *Delivery) error {
+			if publishErr != nil {
+				return nil
+			}
+			if err := d.publish(ctx, delivery); err != nil {
+				publishErr = &DeliveryError{
+					MessageID:   delivery.ID,
+					Destination: delivery.Destination,
+					Retryable:   true,
+					Err:         err,
+				}
+				return nil
+			}
+			published = append(published, delivery.ID)
+			return nil
+		}); err != nil {
+			return err
+		}
+		return d.sender.AckBatch(ctx, tx, published...)
+	}); err != nil {
+		return err
+	}
+	return publishErr
+}
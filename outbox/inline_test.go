@@ -0,0 +1,70 @@
+package outbox
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+
+	sq "github.com/elgris/sqrl"
+	"github.com/lib/pq"
+	"github.com/pentops/outbox.pg.go/internal/fakedb"
+	"github.com/pentops/sqrlx.go/sqrlx"
+)
+
+func TestInlineDeliverReportsOncePerDelivery(t *testing.T) {
+	// the send commits, and then the delivery's first commit fails
+	commits := 0
+	conn := fakedb.Open(func(query string, args []driver.NamedValue) (*fakedb.Result, error) {
+		switch {
+		case strings.HasPrefix(query, "SELECT"):
+			return &fakedb.Result{
+				Columns: []string{"id", "destination", "headers", "message"},
+				Rows: [][]driver.Value{
+					{"msg-1", "test.v1.Topic", "", []byte("body")},
+					{"msg-2", "test.v1.Topic", "", []byte("body")},
+				},
+			}, nil
+		case query == "COMMIT":
+			commits++
+			if commits == 2 {
+				return nil, &pq.Error{Code: "40001", Message: "injected"}
+			}
+		}
+		return &fakedb.Result{RowsAffected: 1}, nil
+	})
+	db, err := sqrlx.New(conn.DB, sq.Dollar)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failure := errors.New("broker unavailable")
+	deliverer := NewInlineDeliverer(db, NewNamedSender(DefaultConfig()), func(ctx context.Context, delivery *Delivery) error {
+		if delivery.ID == "msg-2" {
+			return failure
+		}
+		return nil
+	})
+	reported := []error{}
+	deliverer.OnError = func(err error) {
+		reported = append(reported, err)
+	}
+
+	if err := deliverer.Transact(context.Background(), nil, func(ctx context.Context, tx sqrlx.Transaction, sender *BufferedSender) error {
+		return sender.SendRaw(ctx, tx, &Raw{Destination: "test.v1.Topic", Body: []byte("body")})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if begins := countStatements(conn.Statements(), "BEGIN"); begins != 3 {
+		t.Fatalf("got %d transactions, want the send and a retried delivery", begins)
+	}
+	if len(reported) != 1 {
+		t.Fatalf("got %d errors reported, want 1: %v", len(reported), reported)
+	}
+	deliveryErr := &DeliveryError{}
+	if !errors.As(reported[0], &deliveryErr) || deliveryErr.MessageID != "msg-2" || !errors.Is(reported[0], failure) {
+		t.Errorf("reported %v, want the failure for msg-2", reported[0])
+	}
+}
@@ -0,0 +1,109 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/pentops/sqrlx.go/sqrlx"
+)
+
+// LagBreach is a destination whose oldest undelivered message is older
+// than its SLO.
+type LagBreach struct {
+	Destination string
+	Age         time.Duration
+	Threshold   time.Duration
+	Messages    uint64
+}
+
+// LagMonitor checks the age of the oldest message per destination against
+// an SLO. It reads the table directly, so it keeps working while the relay
+// is down. The sender needs a CreatedAtColumn. Ages are measured with the
+// local clock.
+type LagMonitor struct {
+	db     sqrlx.Transactor
+	sender *NamedSender
+
+	// Maximum age of the oldest message, Thresholds overrides it per
+	// destination. Zero disables the check.
+	Threshold  time.Duration
+	Thresholds map[string]time.Duration
+
+	// Called for each breach found by Check
+	OnBreach func(LagBreach)
+}
+
+func NewLagMonitor(db sqrlx.Transactor, sender *NamedSender, threshold time.Duration, onBreach func(LagBreach)) *LagMonitor {
+	return &LagMonitor{
+		db:        db,
+		sender:    sender,
+		Threshold: threshold,
+		OnBreach:  onBreach,
+	}
+}
+
+func (lm *LagMonitor) threshold(destination string) time.Duration {
+	if threshold, ok := lm.Thresholds[destination]; ok {
+		return threshold
+	}
+	return lm.Threshold
+}
+
+// Check reads the current stats once, returning the breaches after
+// reporting them to OnBreach.
+func (lm *LagMonitor) Check(ctx context.Context) ([]LagBreach, error) {
+	var stats []*DestinationStats
+	var now time.Time
+	if err := lm.db.Transact(ctx, &sqrlx.TxOptions{
+		ReadOnly:  true,
+		Isolation: sql.LevelReadCommitted,
+	}, func(ctx context.Context, tx sqrlx.Transaction) error {
+		var err error
+		stats, err = lm.sender.Stats(ctx, tx)
+		now = time.Now()
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	breaches := []LagBreach{}
+	for _, destStats := range stats {
+		threshold := lm.threshold(destStats.Destination)
+		if threshold == 0 || destStats.Oldest.IsZero() {
+			continue
+		}
+		age := now.Sub(destStats.Oldest)
+		if age <= threshold {
+			continue
+		}
+		breach := LagBreach{
+			Destination: destStats.Destination,
+			Age:         age,
+			Threshold:   threshold,
+			Messages:    destStats.Messages,
+		}
+		if lm.OnBreach != nil {
+			lm.OnBreach(breach)
+		}
+		breaches = append(breaches, breach)
+	}
+	return breaches, nil
+}
+
+// Run calls Check every interval until ctx is done. Failed checks are
+// returned through onError, when set, and don't stop the monitor.
+func (lm *LagMonitor) Run(ctx context.Context, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := lm.Check(ctx); err != nil && ctx.Err() == nil && onError != nil {
+			onError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
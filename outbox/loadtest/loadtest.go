@@ -0,0 +1,294 @@
+// Package loadtest drives a NamedSender against a real database with
+// concurrent producers and claiming relays, reporting throughput and
+// latency, for sizing a deployment and catching regressions in the send
+// and claim paths. It writes to and deletes from the sender's table, so
+// should be pointed at a test database.
+package loadtest
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pentops/outbox.pg.go/outbox"
+	"github.com/pentops/sqrlx.go/sqrlx"
+)
+
+// SentAtHeader carries the send time, for the delivery latency.
+const SentAtHeader = "loadtest-sent-at"
+
+type Config struct {
+	// Concurrent sending transactions, and the messages in each
+	Producers     int
+	MessagesPerTx int
+
+	// Optional, limits each producer's transactions per second
+	ProducerRate float64
+
+	PayloadBytes int
+
+	// Messages are spread over this many destinations, named
+	// DestinationPrefix0, DestinationPrefix1...
+	Destinations      int
+	DestinationPrefix string
+
+	// Concurrent claiming transactions, and the limit for each claim
+	Relays     int
+	ClaimBatch uint64
+
+	// Optional, the stub broker, which succeeds immediately when nil.
+	// PublishLatency is added to every publish.
+	Publish        outbox.PublishFunc
+	PublishLatency time.Duration
+
+	// How long producers run. Relays carry on for up to DrainTimeout
+	// after, until every message sent has been delivered.
+	Duration     time.Duration
+	DrainTimeout time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Producers:         4,
+		MessagesPerTx:     1,
+		PayloadBytes:      256,
+		Destinations:      4,
+		DestinationPrefix: "loadtest.v1.Topic",
+		Relays:            2,
+		ClaimBatch:        100,
+		Duration:          30 * time.Second,
+		DrainTimeout:      30 * time.Second,
+	}
+}
+
+var txOptions = &sqrlx.TxOptions{
+	ReadOnly:  false,
+	Isolation: sql.LevelReadCommitted,
+}
+
+type run struct {
+	db     sqrlx.Transactor
+	sender *outbox.NamedSender
+	config Config
+
+	cancel  context.CancelFunc
+	errLock sync.Mutex
+	err     error
+
+	send    recorder
+	claim   recorder
+	deliver recorder
+}
+
+func (r *run) fail(err error) {
+	r.errLock.Lock()
+	defer r.errLock.Unlock()
+	if r.err == nil {
+		r.err = err
+		r.cancel()
+	}
+}
+
+// Run loads the sender's table with config, returning the first error of
+// any producer or relay, or the report once the run ends.
+func Run(ctx context.Context, db sqrlx.Transactor, sender *outbox.NamedSender, config Config) (*Report, error) {
+	if config.Producers < 1 || config.MessagesPerTx < 1 || config.Relays < 1 || config.Destinations < 1 || config.ClaimBatch < 1 {
+		return nil, fmt.Errorf("loadtest: producers, messages per transaction, relays, destinations and claim batch must be positive")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	r := &run{
+		db:     db,
+		sender: sender,
+		config: config,
+		cancel: cancel,
+	}
+
+	start := time.Now()
+	produceCtx, stopProducers := context.WithTimeout(ctx, config.Duration)
+	defer stopProducers()
+
+	producers := sync.WaitGroup{}
+	for idx := 0; idx < config.Producers; idx++ {
+		producers.Add(1)
+		go func(idx int) {
+			defer producers.Done()
+			r.produce(produceCtx, idx)
+		}(idx)
+	}
+
+	relayCtx, stopRelays := context.WithCancel(ctx)
+	defer stopRelays()
+	relays := sync.WaitGroup{}
+	produced := make(chan struct{})
+	for idx := 0; idx < config.Relays; idx++ {
+		relays.Add(1)
+		go func() {
+			defer relays.Done()
+			r.relay(relayCtx, produced)
+		}()
+	}
+
+	producers.Wait()
+	produceEnd := time.Now()
+	close(produced)
+
+	drain := time.AfterFunc(config.DrainTimeout, stopRelays)
+	relays.Wait()
+	drain.Stop()
+
+	if r.err != nil {
+		return nil, r.err
+	}
+	return &Report{
+		ProduceDuration: produceEnd.Sub(start),
+		TotalDuration:   time.Since(start),
+		Sent:            r.send.count(),
+		Delivered:       r.deliver.count(),
+		Send:            r.send.latencies(),
+		Claim:           r.claim.latencies(),
+		Delivery:        r.deliver.latencies(),
+	}, nil
+}
+
+func (r *run) produce(ctx context.Context, producer int) {
+	payload := make([]byte, r.config.PayloadBytes)
+	var interval time.Duration
+	if r.config.ProducerRate > 0 {
+		interval = time.Duration(float64(time.Second) / r.config.ProducerRate)
+	}
+
+	for seq := 0; ctx.Err() == nil; seq++ {
+		txStart := time.Now()
+		raws := make([]*outbox.Raw, 0, r.config.MessagesPerTx)
+		for idx := 0; idx < r.config.MessagesPerTx; idx++ {
+			destination := r.config.DestinationPrefix + strconv.Itoa((producer+seq+idx)%r.config.Destinations)
+			raws = append(raws, &outbox.Raw{
+				Destination: destination,
+				Headers:     url.Values{SentAtHeader: {txStart.Format(time.RFC3339Nano)}},
+				Body:        payload,
+			})
+		}
+
+		err := r.db.Transact(ctx, txOptions, func(ctx context.Context, tx sqrlx.Transaction) error {
+			return r.sender.SendRawBatch(ctx, tx, raws...)
+		})
+		if err == nil {
+			// committed, even if ctx ended meanwhile, so the relays wait
+			// for it
+			r.send.record(len(raws), time.Since(txStart))
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			r.fail(fmt.Errorf("producer %d: %w", producer, err))
+			return
+		}
+
+		if wait := interval - time.Since(txStart); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+		}
+	}
+}
+
+// relay claims, publishes and acks until ctx is done, or produced is closed
+// and every message sent has been delivered. Counts are recorded once the
+// claim commits, as a retried claim publishes its messages again.
+func (r *run) relay(ctx context.Context, produced <-chan struct{}) {
+	for ctx.Err() == nil {
+		// a claim which started before the last send committed can miss it
+		finished := false
+		select {
+		case <-produced:
+			finished = true
+		default:
+		}
+
+		claimStart := time.Now()
+		var claimed int
+		var latencies []time.Duration
+		err := r.db.Transact(ctx, txOptions, func(ctx context.Context, tx sqrlx.Transaction) error {
+			claimed = 0
+			latencies = latencies[:0]
+			deliveries, err := r.sender.ClaimBatch(ctx, tx, r.config.ClaimBatch)
+			if err != nil {
+				return err
+			}
+			claimed = len(deliveries)
+
+			ids := make([]string, 0, len(deliveries))
+			for _, delivery := range deliveries {
+				latency, err := r.publish(ctx, delivery)
+				if err != nil {
+					return err
+				}
+				if latency > 0 {
+					latencies = append(latencies, latency)
+				}
+				ids = append(ids, delivery.ID)
+			}
+			return r.sender.AckBatch(ctx, tx, ids...)
+		})
+		if err == nil {
+			for _, latency := range latencies {
+				r.deliver.record(1, latency)
+			}
+			if claimed > 0 {
+				r.claim.record(claimed, time.Since(claimStart))
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			r.fail(fmt.Errorf("relay: %w", err))
+			return
+		}
+		if claimed > 0 {
+			continue
+		}
+
+		// other relays may still hold messages, which are released again
+		// if their claim fails to commit
+		if finished && r.deliver.count() >= r.send.count() {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// publish returns the time since the message was sent, or zero for a
+// message sent by something else, which has no send time.
+func (r *run) publish(ctx context.Context, delivery *outbox.Delivery) (time.Duration, error) {
+	if r.config.PublishLatency > 0 {
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(r.config.PublishLatency):
+		}
+	}
+	if r.config.Publish != nil {
+		if err := r.config.Publish(ctx, delivery); err != nil {
+			return 0, err
+		}
+	}
+	sentAt, err := time.Parse(time.RFC3339Nano, delivery.Headers.Get(SentAtHeader))
+	if err != nil {
+		return 0, nil
+	}
+	return time.Since(sentAt), nil
+}
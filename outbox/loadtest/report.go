@@ -0,0 +1,97 @@
+package loadtest
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Report struct {
+	ProduceDuration time.Duration
+	TotalDuration   time.Duration
+
+	Sent      uint64
+	Delivered uint64
+
+	// Per sending transaction, per claiming transaction with messages, and
+	// from send to publish for each message
+	Send     Latencies
+	Claim    Latencies
+	Delivery Latencies
+}
+
+// SendRate is messages sent per second while producers ran.
+func (report *Report) SendRate() float64 {
+	return float64(report.Sent) / report.ProduceDuration.Seconds()
+}
+
+// DeliveryRate is messages delivered per second over the whole run.
+func (report *Report) DeliveryRate() float64 {
+	return float64(report.Delivered) / report.TotalDuration.Seconds()
+}
+
+func (report *Report) String() string {
+	out := &strings.Builder{}
+	fmt.Fprintf(out, "sent %d in %s (%.1f/s), delivered %d in %s (%.1f/s)\n",
+		report.Sent, report.ProduceDuration.Round(time.Millisecond), report.SendRate(),
+		report.Delivered, report.TotalDuration.Round(time.Millisecond), report.DeliveryRate())
+	fmt.Fprintf(out, "send:     %s\n", report.Send)
+	fmt.Fprintf(out, "claim:    %s\n", report.Claim)
+	fmt.Fprintf(out, "delivery: %s\n", report.Delivery)
+	return out.String()
+}
+
+type Latencies struct {
+	Count int
+	P50   time.Duration
+	P95   time.Duration
+	P99   time.Duration
+	Max   time.Duration
+}
+
+func (latencies Latencies) String() string {
+	return fmt.Sprintf("n=%d p50=%s p95=%s p99=%s max=%s", latencies.Count,
+		latencies.P50.Round(time.Microsecond), latencies.P95.Round(time.Microsecond),
+		latencies.P99.Round(time.Microsecond), latencies.Max.Round(time.Microsecond))
+}
+
+type recorder struct {
+	lock      sync.Mutex
+	messages  uint64
+	durations []time.Duration
+}
+
+func (rec *recorder) record(messages int, duration time.Duration) {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	rec.messages += uint64(messages)
+	rec.durations = append(rec.durations, duration)
+}
+
+func (rec *recorder) count() uint64 {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	return rec.messages
+}
+
+func (rec *recorder) latencies() Latencies {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	if len(rec.durations) == 0 {
+		return Latencies{}
+	}
+	sorted := slices.Clone(rec.durations)
+	slices.Sort(sorted)
+	quantile := func(q float64) time.Duration {
+		return sorted[int(q*float64(len(sorted)-1))]
+	}
+	return Latencies{
+		Count: len(sorted),
+		P50:   quantile(0.5),
+		P95:   quantile(0.95),
+		P99:   quantile(0.99),
+		Max:   sorted[len(sorted)-1],
+	}
+}
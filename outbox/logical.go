@@ -0,0 +1,95 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+
+	sq "github.com/elgris/sqrl"
+	"github.com/google/uuid"
+	"github.com/pentops/sqrlx.go/sqrlx"
+)
+
+// LogicalMessage is the content of each logical decoding message written by
+// LogicalMessageSender. Headers are encoded as for the headers column, see
+// DecodeHeaders.
+type LogicalMessage struct {
+	ID          string `json:"id"`
+	Destination string `json:"destination"`
+	Headers     string `json:"headers"`
+	Message     []byte `json:"message"`
+}
+
+// LogicalMessageSender writes messages straight to the WAL with
+// pg_logical_emit_message instead of inserting rows, for deployments which
+// consume the outbox through a replication slot. The messages are
+// transactional, so they are only decoded if the transaction commits.
+type LogicalMessageSender struct {
+	Prefix string
+
+	// Stores proto payloads wrapped in an anypb.Any
+	AnyPayload bool
+
+	// Encoding of LogicalMessage.Headers, defaults to HeaderEncodingURL
+	HeaderEncoding HeaderEncoding
+}
+
+func NewLogicalMessageSender(prefix string) *LogicalMessageSender {
+	return &LogicalMessageSender{
+		Prefix: prefix,
+	}
+}
+
+func (ls *LogicalMessageSender) Send(ctx context.Context, tx sqrlx.Transaction, msg OutboxMessage, opts ...SendOption) error {
+	_, err := ls.SendReturningID(ctx, tx, msg, opts...)
+	return err
+}
+
+func (ls *LogicalMessageSender) SendReturningID(ctx context.Context, tx sqrlx.Transaction, msg OutboxMessage, opts ...SendOption) (string, error) {
+	raw, err := newRaw(msg, ls.AnyPayload)
+	if err != nil {
+		return "", err
+	}
+	applyOptions(raw, opts)
+	return ls.SendRawReturningID(ctx, tx, raw)
+}
+
+func (ls *LogicalMessageSender) SendTo(ctx context.Context, tx sqrlx.Transaction, destination string, msg OutboxMessage, opts ...SendOption) error {
+	raw, err := newRaw(msg, ls.AnyPayload)
+	if err != nil {
+		return err
+	}
+	applyOptions(raw, opts)
+	raw.Destination = destination
+	return ls.SendRaw(ctx, tx, raw)
+}
+
+func (ls *LogicalMessageSender) SendRaw(ctx context.Context, tx sqrlx.Transaction, raw *Raw) error {
+	_, err := ls.SendRawReturningID(ctx, tx, raw)
+	return err
+}
+
+func (ls *LogicalMessageSender) SendRawReturningID(ctx context.Context, tx sqrlx.Transaction, raw *Raw) (string, error) {
+	if err := requireTransaction(tx); err != nil {
+		return "", err
+	}
+
+	id := raw.ID
+	if id == "" {
+		id = uuid.NewString()
+	}
+
+	content, err := json.Marshal(LogicalMessage{
+		ID:          id,
+		Destination: raw.Destination,
+		Headers:     ls.HeaderEncoding.Encode(raw.headers()),
+		Message:     raw.Body,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := tx.Exec(ctx, sq.Expr("SELECT pg_logical_emit_message(true, ?, ?::bytea)", ls.Prefix, content)); err != nil {
+		return "", err
+	}
+	return id, nil
+}
@@ -0,0 +1,32 @@
+package outbox
+
+import "time"
+
+// SendObservation describes one message given to a NamedSender. Every
+// message is observed once, including those which fail to encode, are
+// refused by a guard, or fail with the rest of their batch.
+type SendObservation struct {
+	Destination  string
+	PayloadBytes int
+	// Duration runs from the start of the send call to its result, so
+	// covers encoding when the sender encodes the message (Send, SendTo,
+	// SendBatch), then guards, compaction and the insert round trip. It is
+	// shared by all messages in a batch.
+	Duration time.Duration
+	// The message's own failure from a BatchError, or the send's error.
+	// PayloadBytes is zero for messages which failed to encode.
+	Err error
+}
+
+// SendObserver is the hook for sender metrics, e.g. counting messages and
+// recording payload size and insert latency histograms per destination.
+type SendObserver interface {
+	ObserveSend(SendObservation)
+}
+
+// SendObserverFunc adapts a function to a SendObserver.
+type SendObserverFunc func(SendObservation)
+
+func (f SendObserverFunc) ObserveSend(obs SendObservation) {
+	f(obs)
+}
@@ -0,0 +1,139 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type sleepGuard time.Duration
+
+func (guard sleepGuard) CheckSend(context.Context, *Raw) error {
+	time.Sleep(time.Duration(guard))
+	return nil
+}
+
+func TestSendObservations(t *testing.T) {
+	ctx := context.Background()
+	good := benchMessage(0)
+	// proto3 strings must be valid UTF-8, so this fails to encode
+	bad := &testMessage{
+		StringValue: wrapperspb.String("\xff"),
+		topic:       "bad.v1.Topic",
+	}
+
+	for _, tc := range []struct {
+		name  string
+		setup func(*NamedSender)
+		send  func(*NamedSender) error
+		want  []error
+	}{{
+		name: "sent",
+		send: func(ss *NamedSender) error {
+			return ss.Send(ctx, discardTx{}, good)
+		},
+		want: []error{nil},
+	}, {
+		name: "encode failure",
+		send: func(ss *NamedSender) error {
+			return ss.Send(ctx, discardTx{}, bad)
+		},
+		want: []error{errAny},
+	}, {
+		name: "guard failure",
+		setup: func(ss *NamedSender) {
+			ss.MaxPayloadBytes = 1
+		},
+		send: func(ss *NamedSender) error {
+			return ss.Send(ctx, discardTx{}, good)
+		},
+		want: []error{ErrPayloadTooLarge},
+	}, {
+		name: "no transaction",
+		send: func(ss *NamedSender) error {
+			return ss.Send(ctx, nil, good)
+		},
+		want: []error{ErrNoTransaction},
+	}, {
+		name: "batch encode failure",
+		send: func(ss *NamedSender) error {
+			return ss.SendBatch(ctx, discardTx{}, good, bad)
+		},
+		want: []error{errBatch, errAny},
+	}, {
+		name: "batch guard failure",
+		setup: func(ss *NamedSender) {
+			ss.MaxPayloadBytes = 1
+		},
+		send: func(ss *NamedSender) error {
+			return ss.SendRawBatch(ctx, discardTx{}, &Raw{Destination: "a", Body: []byte("a")}, &Raw{Destination: "b", Body: []byte("bb")})
+		},
+		want: []error{nil, ErrPayloadTooLarge},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			observed := []SendObservation{}
+			sender := NewNamedSender(DefaultConfig())
+			sender.Observer = SendObserverFunc(func(obs SendObservation) {
+				observed = append(observed, obs)
+			})
+			if tc.setup != nil {
+				tc.setup(sender)
+			}
+			sendErr := tc.send(sender)
+
+			if len(observed) != len(tc.want) {
+				t.Fatalf("got %d observations, want %d", len(observed), len(tc.want))
+			}
+			for idx, want := range tc.want {
+				got := observed[idx].Err
+				switch {
+				case want == errAny:
+					if got == nil {
+						t.Errorf("observation %d: expected an error", idx)
+					}
+				case want == errBatch:
+					var batchErr *BatchError
+					if !errors.As(got, &batchErr) {
+						t.Errorf("observation %d: got %v, want the BatchError", idx, got)
+					}
+				case want == nil && sendErr == nil:
+					if got != nil {
+						t.Errorf("observation %d: got %v, want no error", idx, got)
+					}
+				case want == nil:
+					// in a failed batch, refused alongside another message
+					if got != sendErr {
+						t.Errorf("observation %d: got %v, want the batch error", idx, got)
+					}
+				default:
+					if !errors.Is(got, want) {
+						t.Errorf("observation %d: got %v, want %v", idx, got, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+var (
+	errAny   = errors.New("any error")
+	errBatch = errors.New("the BatchError")
+)
+
+func TestSendObservationDurationCoversGuards(t *testing.T) {
+	var observed SendObservation
+	sender := NewNamedSender(DefaultConfig())
+	sender.Guards = []SendGuard{sleepGuard(5 * time.Millisecond)}
+	sender.Observer = SendObserverFunc(func(obs SendObservation) {
+		observed = obs
+	})
+	if err := sender.Send(context.Background(), discardTx{}, benchMessage(0)); err != nil {
+		t.Fatal(err)
+	}
+	if observed.Duration < 5*time.Millisecond {
+		t.Errorf("duration %s does not cover the guard", observed.Duration)
+	}
+}
@@ -0,0 +1,34 @@
+package outbox
+
+import (
+	"context"
+
+	sq "github.com/elgris/sqrl"
+	"github.com/pentops/sqrlx.go/sqrlx"
+)
+
+// LockForMigration takes the MigrationLockKey advisory lock exclusively
+// for the rest of tx, waiting for running claims to finish. Claims made
+// while it is held return no messages, and resume once tx ends, so a
+// migration of the outbox table can't race active claims.
+func (ss *NamedSender) LockForMigration(ctx context.Context, tx sqrlx.Transaction) error {
+	if err := requireTransaction(tx); err != nil {
+		return err
+	}
+	_, err := tx.Exec(ctx, sq.Expr("SELECT pg_advisory_xact_lock(?)", ss.MigrationLockKey))
+	return err
+}
+
+// migrationPaused takes the lock shared for the claiming transaction,
+// failing to get it while a migration holds it. Transaction level locks
+// also work behind transaction-pooling pgbouncer.
+func (ss *NamedSender) migrationPaused(ctx context.Context, tx sqrlx.Transaction) (bool, error) {
+	if ss.MigrationLockKey == 0 {
+		return false, nil
+	}
+	var locked bool
+	if err := tx.QueryRow(ctx, sq.Expr("SELECT pg_try_advisory_xact_lock_shared(?)", ss.MigrationLockKey)).Scan(&locked); err != nil {
+		return false, err
+	}
+	return !locked, nil
+}
@@ -0,0 +1,61 @@
+package outbox
+
+import (
+	"context"
+)
+
+// SendOption adjusts a message at the call site, after it is encoded.
+type SendOption func(*Raw)
+
+// WithHeader sets a header for this send, replacing any value from
+// MessagingHeaders, for request scoped values such as an idempotency key or
+// the acting user.
+func WithHeader(key string, value string) SendOption {
+	return func(raw *Raw) {
+		raw.setHeader(key, value)
+	}
+}
+
+func applyOptions(raw *Raw, opts []SendOption) {
+	for _, opt := range opts {
+		opt(raw)
+	}
+}
+
+// HeaderExtractor reads headers from the context of a send, e.g. the auth
+// subject, tenant or request ID.
+type HeaderExtractor func(ctx context.Context) map[string]string
+
+// ContextValueHeader extracts the string stored in the context under
+// contextKey as header key.
+func ContextValueHeader(key string, contextKey any) HeaderExtractor {
+	return func(ctx context.Context) map[string]string {
+		value, ok := ctx.Value(contextKey).(string)
+		if !ok || value == "" {
+			return nil
+		}
+		return map[string]string{key: value}
+	}
+}
+
+// withContextHeaders adds the sender's extracted headers which the message
+// doesn't already have, returning a copy when any are added.
+func (ss *NamedSender) withContextHeaders(ctx context.Context, raw *Raw) *Raw {
+	if len(ss.HeaderExtractors) == 0 {
+		return raw
+	}
+	withHeaders := raw
+	for _, extractor := range ss.HeaderExtractors {
+		for key, value := range extractor(ctx) {
+			if _, ok := withHeaders.Headers[key]; ok {
+				continue
+			}
+			if withHeaders == raw {
+				copied := *raw
+				withHeaders = &copied
+			}
+			withHeaders.setHeader(key, value)
+		}
+	}
+	return withHeaders
+}
@@ -0,0 +1,44 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+
+	sq "github.com/elgris/sqrl"
+	"github.com/pentops/sqrlx.go/sqrlx"
+)
+
+// Peek reads up to limit messages for destination without claiming or
+// deleting them, for dashboards and support tooling. Messages are in claim
+// order: highest PriorityColumn first, then oldest by CreatedAtColumn and
+// AggregateSequenceColumn, for whichever of those the sender has. Messages
+// claimed by a relay are included.
+func (ss *NamedSender) Peek(ctx context.Context, tx sqrlx.Transaction, destination string, limit uint64) ([]*Delivery, error) {
+	return ss.claim(ctx, tx, limit, claimFilter{destination: destination, peek: true})
+}
+
+// Peek reads messages from the DefaultSender's table in a read-only
+// transaction.
+func Peek(ctx context.Context, conn sqrlx.Connection, destination string, limit uint64) ([]*Delivery, error) {
+	sender, err := defaultNamedSender()
+	if err != nil {
+		return nil, err
+	}
+	db, err := sqrlx.New(conn, sq.Dollar)
+	if err != nil {
+		return nil, err
+	}
+	var deliveries []*Delivery
+	if err := db.Transact(ctx, &sqrlx.TxOptions{
+		ReadOnly:  true,
+		Retryable: true,
+		Isolation: sql.LevelReadCommitted,
+	}, func(ctx context.Context, tx sqrlx.Transaction) error {
+		var err error
+		deliveries, err = sender.Peek(ctx, tx, destination, limit)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
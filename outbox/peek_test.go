@@ -0,0 +1,68 @@
+package outbox
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"testing"
+
+	"github.com/pentops/outbox.pg.go/internal/fakedb"
+)
+
+func TestPeekOrder(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		config func(*NamedSender)
+		want   string
+	}{{
+		name:   "unordered",
+		config: func(*NamedSender) {},
+		want:   "",
+	}, {
+		name: "oldest",
+		config: func(ss *NamedSender) {
+			ss.CreatedAtColumn = "created_at"
+		},
+		want: " ORDER BY created_at",
+	}, {
+		name: "priority first",
+		config: func(ss *NamedSender) {
+			ss.PriorityColumn = "priority"
+			ss.CreatedAtColumn = "created_at"
+			ss.AggregateSequenceColumn = "aggregate_sequence"
+		},
+		want: " ORDER BY priority DESC, created_at, aggregate_sequence",
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			db := fakedb.Open(func(string, []driver.NamedValue) (*fakedb.Result, error) {
+				return &fakedb.Result{}, nil
+			})
+			sender := NewNamedSender(DefaultConfig())
+			tc.config(sender)
+			withDefaultSender(t, sender)
+
+			if _, err := Peek(context.Background(), db.DB, "test.v1.Topic", 10); err != nil {
+				t.Fatal(err)
+			}
+			if order := selectOrder(t, db); order != tc.want {
+				t.Errorf("got %q, want %q", order, tc.want)
+			}
+		})
+	}
+}
+
+// selectOrder returns the ORDER BY clause of the first SELECT.
+func selectOrder(t *testing.T, db *fakedb.DB) string {
+	t.Helper()
+	for _, statement := range db.Statements() {
+		if !strings.HasPrefix(statement, "SELECT") {
+			continue
+		}
+		if idx := strings.Index(statement, " ORDER BY"); idx >= 0 {
+			return statement[idx:strings.Index(statement, " LIMIT")]
+		}
+		return ""
+	}
+	t.Fatal("no SELECT")
+	return ""
+}
@@ -0,0 +1,131 @@
+package outbox
+
+import (
+	"strings"
+)
+
+// SendFunctionDDL returns a CREATE FUNCTION statement for a PL/pgSQL
+// function which writes a message to the sender's table the way Send does,
+// so that triggers and stored procedures can enqueue messages too:
+//
+//	SELECT outbox_send('foo.v1.Topic', '{"grpc-service": "/foo.v1.Topic/Bar"}', payload);
+//
+// Passing an aggregate type and ID as well sends the way SendForAggregate
+// does, numbered from the SequenceTable when set:
+//
+//	SELECT outbox_send('foo.v1.Topic', '{}', payload, 'order', order_id);
+//
+// The function returns the new message ID. Headers are stored in the
+// sender's HeaderEncoding, through a variable of the headers column's type,
+// so text and jsonb columns both work. IDs come from gen_random_uuid, which
+// needs Postgres 13 or pgcrypto.
+func (ss *NamedSender) SendFunctionDDL(functionName string) string {
+	columns := []string{ss.IDColumn, ss.DestinationColumn, ss.HeadersColumn, ss.DataColumn}
+	values := []string{"msg_id", "msg_destination", "msg_headers_value", "msg_payload"}
+
+	if ss.AggregateTypeColumn != "" {
+		columns = append(columns, ss.AggregateTypeColumn)
+		values = append(values, "msg_aggregate_type")
+	}
+	if ss.AggregateIDColumn != "" {
+		columns = append(columns, ss.AggregateIDColumn)
+		values = append(values, "msg_aggregate_id")
+	}
+	if ss.RegionColumn != "" {
+		columns = append(columns, ss.RegionColumn)
+		values = append(values, "nullif(msg_headers->>'"+RegionHeader+"', '')")
+	}
+	if ss.CompactionKeyColumn != "" {
+		columns = append(columns, ss.CompactionKeyColumn)
+		values = append(values, "nullif(msg_headers->>'"+CompactionKeyHeader+"', '')")
+	}
+	if ss.PriorityColumn != "" {
+		columns = append(columns, ss.PriorityColumn)
+		values = append(values, "0")
+	}
+	if ss.AggregateSequenceColumn != "" {
+		columns = append(columns, ss.AggregateSequenceColumn)
+		values = append(values, "msg_sequence")
+	}
+
+	body := &strings.Builder{}
+	body.WriteString("CREATE OR REPLACE FUNCTION " + functionName + "(msg_destination text, msg_headers jsonb, msg_payload bytea, msg_aggregate_type text DEFAULT NULL, msg_aggregate_id text DEFAULT NULL) RETURNS text\n")
+	body.WriteString("LANGUAGE plpgsql AS $outbox$\n")
+	body.WriteString("DECLARE\n")
+	body.WriteString("\tmsg_id " + ss.TableName + "." + ss.IDColumn + "%TYPE := gen_random_uuid();\n")
+	body.WriteString("\tmsg_headers_value " + ss.TableName + "." + ss.HeadersColumn + "%TYPE;\n")
+	body.WriteString("\tmsg_headers_text text;\n")
+	body.WriteString("\tmsg_sequence bigint;\n")
+	body.WriteString("BEGIN\n")
+	body.WriteString("\tmsg_headers := coalesce(msg_headers, '{}');\n")
+	if ss.Region != "" {
+		body.WriteString("\tIF coalesce(msg_headers->>'" + RegionHeader + "', '') = '' THEN\n")
+		body.WriteString("\t\tmsg_headers := msg_headers || jsonb_build_object('" + RegionHeader + "', " + sqlString(ss.Region) + ");\n")
+		body.WriteString("\tEND IF;\n")
+	}
+
+	// as SendForAggregate, or the destination and ID as Send
+	body.WriteString("\tIF msg_aggregate_type IS NOT NULL OR msg_aggregate_id IS NOT NULL THEN\n")
+	body.WriteString("\t\tmsg_aggregate_type := coalesce(msg_aggregate_type, '');\n")
+	body.WriteString("\t\tmsg_aggregate_id := coalesce(msg_aggregate_id, '');\n")
+	body.WriteString("\t\tmsg_headers := msg_headers || jsonb_build_object('" + AggregateTypeHeader + "', msg_aggregate_type, '" + AggregateIDHeader + "', msg_aggregate_id);\n")
+	if ss.SequenceTable != "" {
+		body.WriteString("\t\tINSERT INTO " + ss.SequenceTable + " (aggregate_type, aggregate_id, sequence) VALUES (msg_aggregate_type, msg_aggregate_id, 1)" +
+			" ON CONFLICT (aggregate_type, aggregate_id) DO UPDATE SET sequence = " + ss.SequenceTable + ".sequence + EXCLUDED.sequence" +
+			" RETURNING sequence INTO msg_sequence;\n")
+		body.WriteString("\t\tmsg_headers := msg_headers || jsonb_build_object('" + AggregateSequenceHeader + "', msg_sequence::text);\n")
+	}
+	body.WriteString("\tELSE\n")
+	body.WriteString("\t\tmsg_aggregate_type := msg_destination;\n")
+	body.WriteString("\t\tmsg_aggregate_id := msg_id::text;\n")
+	body.WriteString("\tEND IF;\n")
+
+	if ss.HeaderEncoding == HeaderEncodingJSON {
+		// {"key": "value"} is stored as {"key": ["value"]}, the url.Values form
+		body.WriteString("\tSELECT coalesce(jsonb_object_agg(key, jsonb_build_array(coalesce(value, ''))), '{}')::text INTO msg_headers_text FROM jsonb_each_text(msg_headers);\n")
+	} else {
+		// as url.Values.Encode, sorted by the bytes of the key
+		body.WriteString("\tSELECT coalesce(string_agg(" + sqlQueryEscape("key") + " || '=' || " + sqlQueryEscape("coalesce(value, '')") + ", '&' ORDER BY convert_to(key, 'UTF8')), '') INTO msg_headers_text FROM jsonb_each_text(msg_headers);\n")
+	}
+	// the assignment casts to the column's type, e.g. jsonb
+	body.WriteString("\tmsg_headers_value := msg_headers_text;\n")
+
+	if ss.CompactionKeyColumn != "" {
+		compactable := ""
+		if ss.DeliveredAtColumn != "" {
+			compactable = " AND " + ss.DeliveredAtColumn + " IS NULL"
+		}
+		// sequenced messages are never compacted, see compact
+		if ss.AggregateSequenceColumn != "" {
+			compactable += " AND " + ss.AggregateSequenceColumn + " IS NULL"
+		}
+		body.WriteString("\tIF msg_sequence IS NULL AND msg_headers ? '" + CompactionKeyHeader + "' THEN\n")
+		body.WriteString("\t\tDELETE FROM " + ss.TableName + " WHERE " + ss.IDColumn + " IN (SELECT " + ss.IDColumn + " FROM " + ss.TableName +
+			" WHERE " + ss.DestinationColumn + " = msg_destination AND " + ss.CompactionKeyColumn + " = msg_headers->>'" + CompactionKeyHeader + "'" + compactable + " FOR UPDATE SKIP LOCKED);\n")
+		body.WriteString("\tEND IF;\n")
+	}
+	body.WriteString("\tINSERT INTO " + ss.TableName + " (" + strings.Join(columns, ", ") + ") VALUES (" + strings.Join(values, ", ") + ");\n")
+	if ss.NotifyChannel != "" {
+		body.WriteString("\tPERFORM pg_notify(" + sqlString(ss.NotifyChannel) + ", msg_destination);\n")
+	}
+	body.WriteString("\tRETURN msg_id::text;\n")
+	body.WriteString("END;\n")
+	body.WriteString("$outbox$;\n")
+	return body.String()
+}
+
+// sqlQueryEscape is url.QueryEscape of a text expression: UTF-8 bytes other
+// than letters, digits and -_.~ are percent encoded, and spaces become '+'.
+func sqlQueryEscape(expression string) string {
+	return "(SELECT coalesce(string_agg(CASE" +
+		" WHEN b BETWEEN 48 AND 57 OR b BETWEEN 65 AND 90 OR b BETWEEN 97 AND 122 OR b IN (45, 46, 95, 126) THEN chr(b)" +
+		" WHEN b = 32 THEN '+'" +
+		" ELSE '%' || upper(lpad(to_hex(b), 2, '0')) END, '' ORDER BY i), '')" +
+		" FROM (SELECT convert_to(" + expression + ", 'UTF8') AS bytes) AS escaped," +
+		" generate_series(0, length(escaped.bytes) - 1) AS i," +
+		" get_byte(escaped.bytes, i) AS b)"
+}
+
+func sqlString(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
@@ -0,0 +1,149 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pentops/outbox.pg.go/internal/pgtest"
+	"github.com/pentops/sqrlx.go/sqrlx"
+)
+
+func TestSendFunctionDDLShape(t *testing.T) {
+	sender := NewNamedSender(DefaultConfig())
+	sender.AggregateSequenceColumn = "aggregate_sequence"
+	sender.SequenceTable = "outbox_aggregate_sequence"
+
+	ddl := sender.SendFunctionDDL("outbox_send")
+	for _, want := range []string{
+		"msg_headers_value outbox.headers%TYPE;",
+		"msg_headers_value := msg_headers_text;",
+		"string_agg(", // URL encoded
+		"INSERT INTO outbox_aggregate_sequence",
+		"INSERT INTO outbox (id, destination, headers, message, aggregate_sequence) VALUES (msg_id, msg_destination, msg_headers_value, msg_payload, msg_sequence);",
+	} {
+		if !strings.Contains(ddl, want) {
+			t.Errorf("DDL is missing %q:\n%s", want, ddl)
+		}
+	}
+
+	sender.HeaderEncoding = HeaderEncodingJSON
+	if ddl := sender.SendFunctionDDL("outbox_send"); !strings.Contains(ddl, "jsonb_object_agg(") {
+		t.Errorf("JSON encoded DDL:\n%s", ddl)
+	}
+}
+
+type functionRow struct {
+	id       string
+	headers  string
+	region   sql.NullString
+	key      sql.NullString
+	sequence sql.NullInt64
+}
+
+// TestSendFunctionDDL runs the generated function against each headers
+// column type, needing TEST_DB.
+func TestSendFunctionDDL(t *testing.T) {
+	headers := `{"grpc-service": "/foo.v1.Topic/Bar", "x-odd": "a b+c~é*'&=%", "compaction-key": "k1"}`
+	expected := url.Values{
+		GRPCServiceHeader:   {"/foo.v1.Topic/Bar"},
+		"x-odd":             {"a b+c~é*'&=%"},
+		CompactionKeyHeader: {"k1"},
+		RegionHeader:        {"eu"},
+	}
+
+	for _, tc := range []struct {
+		name       string
+		headerType string
+		encoding   HeaderEncoding
+	}{
+		{"url text", "text", HeaderEncodingURL},
+		{"json text", "text", HeaderEncodingJSON},
+		{"json jsonb", "jsonb", HeaderEncodingJSON},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			db := pgtest.DB(t)
+			pgtest.Exec(t, db,
+				"CREATE TABLE outbox (id uuid PRIMARY KEY, destination text NOT NULL, headers "+tc.headerType+" NOT NULL, message bytea NOT NULL,"+
+					" aggregate_type text, aggregate_id text, region text, compaction_key text, priority int, aggregate_sequence bigint)",
+				"CREATE TABLE outbox_aggregate_sequence (aggregate_type text NOT NULL, aggregate_id text NOT NULL, sequence bigint NOT NULL, PRIMARY KEY (aggregate_type, aggregate_id))",
+			)
+			sender := NewNamedSender(DefaultConfig())
+			sender.AggregateTypeColumn = "aggregate_type"
+			sender.AggregateIDColumn = "aggregate_id"
+			sender.RegionColumn = "region"
+			sender.CompactionKeyColumn = "compaction_key"
+			sender.PriorityColumn = "priority"
+			sender.AggregateSequenceColumn = "aggregate_sequence"
+			sender.SequenceTable = "outbox_aggregate_sequence"
+			sender.Region = "eu"
+			sender.HeaderEncoding = tc.encoding
+			pgtest.Exec(t, db, sender.SendFunctionDDL("outbox_send"))
+
+			send := func(query string) {
+				archiveBenchTx(t, db, func(ctx context.Context, tx sqrlx.Transaction) error {
+					_, err := tx.ExecRaw(ctx, query, headers)
+					return err
+				})
+			}
+			// the second replaces the first by compaction, the sequenced
+			// sends are kept
+			send("SELECT outbox_send('foo.v1.Topic', $1::jsonb, 'a')")
+			send("SELECT outbox_send('foo.v1.Topic', $1::jsonb, 'b')")
+			send("SELECT outbox_send('foo.v1.Topic', $1::jsonb, 'c', 'order', 'o-1')")
+			send("SELECT outbox_send('foo.v1.Topic', $1::jsonb, 'd', 'order', 'o-1')")
+
+			rows := []functionRow{}
+			archiveBenchTx(t, db, func(ctx context.Context, tx sqrlx.Transaction) error {
+				rows = rows[:0]
+				result, err := tx.QueryRaw(ctx, "SELECT id::text, headers::text, region, compaction_key, aggregate_sequence FROM outbox ORDER BY message")
+				if err != nil {
+					return err
+				}
+				defer result.Close()
+				for result.Next() {
+					row := functionRow{}
+					if err := result.Scan(&row.id, &row.headers, &row.region, &row.key, &row.sequence); err != nil {
+						return err
+					}
+					rows = append(rows, row)
+				}
+				return result.Err()
+			})
+			if len(rows) != 3 {
+				t.Fatalf("got %d rows, want the compacted send and two sequenced", len(rows))
+			}
+
+			for idx, row := range rows {
+				want := url.Values{}
+				for k, v := range expected {
+					want[k] = v
+				}
+				if idx > 0 {
+					want.Set(AggregateTypeHeader, "order")
+					want.Set(AggregateIDHeader, "o-1")
+					want.Set(AggregateSequenceHeader, []string{"1", "2"}[idx-1])
+				}
+				if tc.encoding == HeaderEncodingURL && row.headers != want.Encode() {
+					t.Errorf("row %d: stored %q, Send stores %q", idx, row.headers, want.Encode())
+				}
+				decoded, err := DecodeHeaders(row.headers)
+				if err != nil {
+					t.Fatalf("row %d: %s", idx, err)
+				}
+				if !reflect.DeepEqual(decoded, want) {
+					t.Errorf("row %d: headers %v, want %v", idx, decoded, want)
+				}
+				if row.region.String != "eu" || row.key.String != "k1" {
+					t.Errorf("row %d: region %v, compaction key %v", idx, row.region, row.key)
+				}
+				if wantSequence := int64(idx); row.sequence.Int64 != wantSequence || row.sequence.Valid != (idx > 0) {
+					t.Errorf("row %d: sequence %v, want %d", idx, row.sequence, wantSequence)
+				}
+			}
+		})
+	}
+}
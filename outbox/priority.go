@@ -0,0 +1,14 @@
+package outbox
+
+// ControlPriority is the reserved priority band for operational messages,
+// e.g. cache invalidation and config changes, which must not wait behind a
+// bulk backlog. Application messages should stay below it.
+const ControlPriority int32 = 1000
+
+// PriorityMessage is implemented by messages which set their priority, for
+// senders with a PriorityColumn. Messages are claimed highest first, the
+// default is zero.
+type PriorityMessage interface {
+	OutboxMessage
+	MessagingPriority() int32
+}
@@ -0,0 +1,79 @@
+package outbox
+
+import (
+	"context"
+	"hash/fnv"
+)
+
+// PublishFunc hands a claimed message to a broker, see InlineDeliverer,
+// FaultInjector, Canary and TagRoute.
+type PublishFunc func(context.Context, *Delivery) error
+
+// Canary sends a share of each destination's messages to a new publisher,
+// for migrating between brokers. Messages are chosen by a hash of their
+// ID, so a retried message goes the same way.
+type Canary struct {
+	Canary PublishFunc
+
+	// Optional, receives the remaining messages. When nil they fail with
+	// ErrDeliveryHeld, staying in the outbox until the canary is widened.
+	Primary PublishFunc
+
+	// Share of messages for the canary, from 0 to 1 as for
+	// FaultInjector.FailureRate, Rates overrides it per destination
+	Rate  float64
+	Rates map[string]float64
+}
+
+func (c *Canary) rate(destination string) float64 {
+	if rate, ok := c.Rates[destination]; ok {
+		return rate
+	}
+	return c.Rate
+}
+
+func (c *Canary) Publish(ctx context.Context, delivery *Delivery) error {
+	hash := fnv.New32a()
+	hash.Write([]byte(delivery.ID))
+	if float64(hash.Sum32()%10000) < c.rate(delivery.Destination)*10000 {
+		return c.Canary(ctx, delivery)
+	}
+	if c.Primary == nil {
+		return &DeliveryError{
+			MessageID:   delivery.ID,
+			Destination: delivery.Destination,
+			Retryable:   true,
+			Err:         ErrDeliveryHeld,
+		}
+	}
+	return c.Primary(ctx, delivery)
+}
+
+// DualPublish sends every message to both the old and new broker during a
+// migration. The old broker decides the outcome, so a failing new broker
+// can't hold up delivery unless RequireNew is set.
+type DualPublish struct {
+	Old PublishFunc
+	New PublishFunc
+
+	RequireNew bool
+
+	// Optional, called with the outcome for each target, e.g. to record
+	// receipts for ReconcileReceipts
+	OnOutcome func(delivery *Delivery, oldErr error, newErr error)
+}
+
+func (dp *DualPublish) Publish(ctx context.Context, delivery *Delivery) error {
+	oldErr := dp.Old(ctx, delivery)
+	newErr := dp.New(ctx, delivery)
+	if dp.OnOutcome != nil {
+		dp.OnOutcome(delivery, oldErr, newErr)
+	}
+	if oldErr != nil {
+		return oldErr
+	}
+	if dp.RequireNew {
+		return newErr
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestCanaryRate(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		rate     float64
+		perDest  map[string]float64
+		min, max int
+	}{
+		{name: "none", rate: 0, min: 0, max: 0},
+		{name: "five percent", rate: 0.05, min: 30, max: 70},
+		{name: "all", rate: 1, min: 1000, max: 1000},
+		{name: "destination override", rate: 1, perDest: map[string]float64{"test.v1.Topic": 0}, min: 0, max: 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			canaried := 0
+			canary := &Canary{
+				Canary: func(context.Context, *Delivery) error {
+					canaried++
+					return nil
+				},
+				Rate:  tc.rate,
+				Rates: tc.perDest,
+			}
+			for i := 0; i < 1000; i++ {
+				err := canary.Publish(context.Background(), &Delivery{ID: fmt.Sprintf("msg-%d", i), Destination: "test.v1.Topic"})
+				if err != nil && !errors.Is(err, ErrDeliveryHeld) {
+					t.Fatal(err)
+				}
+			}
+			if canaried < tc.min || canaried > tc.max {
+				t.Errorf("canaried %d of 1000, want %d to %d", canaried, tc.min, tc.max)
+			}
+		})
+	}
+}
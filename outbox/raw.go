@@ -0,0 +1,177 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/pentops/sqrlx.go/sqrlx"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// ContentTypeHeader holds Raw.ContentType when it is set.
+const ContentTypeHeader = "content-type"
+
+// RegionHeader holds the region whose broker should receive the message.
+const RegionHeader = "region"
+
+// Raw is an encoded outbox message. Proto messages are converted to Raw by
+// NewRaw when sent, other payloads (JSON, Avro, CSV) can be sent as Raw
+// directly through a RawSender.
+type Raw struct {
+	// Optional, a new UUID is generated when empty
+	ID string
+
+	Destination string
+	Headers     url.Values
+	Body        []byte
+
+	// Optional, stored in the content-type header
+	ContentType string
+
+	// Optional, for senders with aggregate columns
+	AggregateType     string
+	AggregateID       string
+	AggregateSequence uint64
+
+	// Optional, for senders with a priority column
+	Priority int32
+}
+
+// NewRaw encodes a proto message.
+func NewRaw(msg OutboxMessage) (*Raw, error) {
+	return newRaw(msg, false)
+}
+
+// NewAnyRaw encodes a proto message wrapped in an anypb.Any, so that the
+// stored payload carries its own type URL.
+func NewAnyRaw(msg OutboxMessage) (*Raw, error) {
+	return newRaw(msg, true)
+}
+
+func newRaw(msg OutboxMessage, wrapAny bool) (*Raw, error) {
+	var payload proto.Message = msg
+	if wrapAny {
+		wrapped, err := anypb.New(msg)
+		if err != nil {
+			return nil, err
+		}
+		payload = wrapped
+	}
+
+	msgBytes, err := proto.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := &Raw{
+		Destination: msg.MessagingTopic(),
+		Headers:     messageHeaders(msg),
+		Body:        msgBytes,
+	}
+
+	if aggregate, ok := msg.(AggregateMessage); ok {
+		raw.AggregateType, raw.AggregateID = aggregate.MessagingAggregate()
+	}
+
+	if prioritised, ok := msg.(PriorityMessage); ok {
+		raw.Priority = prioritised.MessagingPriority()
+	}
+
+	if versioned, ok := msg.(VersionedMessage); ok {
+		if version := versioned.MessagingVersion(); version != "" {
+			raw.setHeader(MessageVersionHeader, version)
+		}
+	}
+
+	return raw, nil
+}
+
+// MultiHeaderMessage is implemented by messages with repeated headers, e.g.
+// several trace states, which are added to the MessagingHeaders values.
+type MultiHeaderMessage interface {
+	OutboxMessage
+	MessagingMultiHeaders() map[string][]string
+}
+
+func messageHeaders(msg OutboxMessage) url.Values {
+	single := msg.MessagingHeaders()
+	headers := make(url.Values, len(single))
+	// one backing array rather than a slice per header, capped so that a
+	// later Add copies instead of overwriting the next header's value
+	values := make([]string, 0, len(single))
+	for k, v := range single {
+		values = append(values, v)
+		headers[k] = values[len(values)-1 : len(values) : len(values)]
+	}
+	if multi, ok := msg.(MultiHeaderMessage); ok {
+		for k, values := range multi.MessagingMultiHeaders() {
+			headers[k] = append(headers[k], values...)
+		}
+	}
+	return headers
+}
+
+// setHeader copies the headers before replacing one, as they may belong to
+// the caller.
+func (raw *Raw) setHeader(key, value string) {
+	headers := make(url.Values, len(raw.Headers)+1)
+	for k, v := range raw.Headers {
+		headers[k] = v
+	}
+	headers.Set(key, value)
+	raw.Headers = headers
+}
+
+func (raw *Raw) headers() url.Values {
+	if raw.ContentType == "" {
+		return raw.Headers
+	}
+	headers := make(url.Values, len(raw.Headers)+1)
+	for k, v := range raw.Headers {
+		headers[k] = v
+	}
+	headers.Set(ContentTypeHeader, raw.ContentType)
+	return headers
+}
+
+type RawSender interface {
+	SendRaw(ctx context.Context, tx sqrlx.Transaction, raw *Raw) error
+}
+
+// IDSender is implemented by senders which can return the ID of the
+// message they wrote, for logging or correlation.
+type IDSender interface {
+	SendReturningID(ctx context.Context, tx sqrlx.Transaction, msg OutboxMessage, opts ...SendOption) (string, error)
+}
+
+// DestinationSender is implemented by senders which can override the
+// destination of a message.
+type DestinationSender interface {
+	SendTo(ctx context.Context, tx sqrlx.Transaction, destination string, msg OutboxMessage, opts ...SendOption) error
+}
+
+func SendTo(ctx context.Context, tx sqrlx.Transaction, destination string, msg OutboxMessage, opts ...SendOption) error {
+	destinationSender, ok := DefaultSender.(DestinationSender)
+	if !ok {
+		return fmt.Errorf("%w: %T can not override destinations", ErrUnsupportedSender, DefaultSender)
+	}
+	return destinationSender.SendTo(ctx, tx, destination, msg, opts...)
+}
+
+func SendReturningID(ctx context.Context, tx sqrlx.Transaction, msg OutboxMessage, opts ...SendOption) (string, error) {
+	idSender, ok := DefaultSender.(IDSender)
+	if !ok {
+		return "", fmt.Errorf("%w: %T can not return message IDs", ErrUnsupportedSender, DefaultSender)
+	}
+	return idSender.SendReturningID(ctx, tx, msg, opts...)
+}
+
+func SendRaw(ctx context.Context, tx sqrlx.Transaction, raw *Raw) error {
+	rawSender, ok := DefaultSender.(RawSender)
+	if !ok {
+		return fmt.Errorf("%w: %T can not send raw messages", ErrUnsupportedSender, DefaultSender)
+	}
+	return rawSender.SendRaw(ctx, tx, raw)
+}
@@ -0,0 +1,142 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	sq "github.com/elgris/sqrl"
+	"github.com/pentops/sqrlx.go/sqrlx"
+)
+
+// Receipt records the hand-off of a message to a broker, with the
+// identifiers the broker returned, e.g. an SQS MessageId or a Kafka
+// partition and offset in Detail.
+type Receipt struct {
+	MessageID   string
+	Destination string
+	Publisher   string
+	ExternalID  string
+	Detail      map[string]string
+	DeliveredAt time.Time
+}
+
+// RecordReceipts writes receipts to ReceiptTable, normally in the same
+// transaction as AckBatch so that every acked message has one. The table
+// needs the columns:
+//
+//	CREATE TABLE outbox_receipt (
+//		message_id text NOT NULL,
+//		destination text NOT NULL,
+//		publisher text NOT NULL,
+//		external_id text,
+//		detail jsonb,
+//		delivered_at timestamptz NOT NULL DEFAULT now()
+//	);
+//	CREATE INDEX ON outbox_receipt (message_id);
+//
+// A zero DeliveredAt uses the database time.
+func (ss *NamedSender) RecordReceipts(ctx context.Context, tx sqrlx.Transaction, receipts ...*Receipt) error {
+	if err := requireTransaction(tx); err != nil {
+		return err
+	}
+	if len(receipts) == 0 {
+		return nil
+	}
+
+	insert := sq.Insert(ss.ReceiptTable).
+		Columns("message_id", "destination", "publisher", "external_id", "detail", "delivered_at")
+	for _, receipt := range receipts {
+		var detail interface{}
+		if len(receipt.Detail) > 0 {
+			encoded, err := json.Marshal(receipt.Detail)
+			if err != nil {
+				return err
+			}
+			detail = string(encoded)
+		}
+		var externalID interface{}
+		if receipt.ExternalID != "" {
+			externalID = receipt.ExternalID
+		}
+		var deliveredAt interface{} = sq.Expr("now()")
+		if !receipt.DeliveredAt.IsZero() {
+			deliveredAt = receipt.DeliveredAt
+		}
+		insert = insert.Values(receipt.MessageID, receipt.Destination, receipt.Publisher, externalID, detail, deliveredAt)
+	}
+
+	_, err := tx.Insert(ctx, insert)
+	return err
+}
+
+// Receipts returns the receipts recorded for a message, oldest first.
+func (ss *NamedSender) Receipts(ctx context.Context, tx sqrlx.Transaction, messageID string) ([]*Receipt, error) {
+	rows, err := tx.Select(ctx, sq.Select("message_id", "destination", "publisher", "coalesce(external_id, '')", "coalesce(detail::text, '')", "delivered_at").
+		From(ss.ReceiptTable).
+		Where(sq.Eq{"message_id": messageID}).
+		OrderBy("delivered_at"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	receipts := []*Receipt{}
+	for rows.Next() {
+		var detail string
+		receipt := &Receipt{}
+		if err := rows.Scan(&receipt.MessageID, &receipt.Destination, &receipt.Publisher, &receipt.ExternalID, &detail, &receipt.DeliveredAt); err != nil {
+			return nil, err
+		}
+		if detail != "" {
+			if err := json.Unmarshal([]byte(detail), &receipt.Detail); err != nil {
+				return nil, err
+			}
+		}
+		receipts = append(receipts, receipt)
+	}
+	return receipts, rows.Err()
+}
+
+// ReceiptReconciliation lists messages with a receipt from only one of two
+// publishers.
+type ReceiptReconciliation struct {
+	OnlyA []string
+	OnlyB []string
+}
+
+// ReconcileReceipts compares the receipts of two publishers, e.g. the old
+// and new broker of a DualPublish, for messages delivered since.
+func (ss *NamedSender) ReconcileReceipts(ctx context.Context, tx sqrlx.Transaction, publisherA string, publisherB string, since time.Time) (*ReceiptReconciliation, error) {
+	rows, err := tx.Select(ctx, sq.Select("message_id").
+		Column("bool_or(publisher = ?)", publisherA).
+		Column("bool_or(publisher = ?)", publisherB).
+		From(ss.ReceiptTable).
+		Where(sq.Eq{"publisher": []string{publisherA, publisherB}}).
+		Where(sq.GtOrEq{"delivered_at": since}).
+		GroupBy("message_id").
+		Having("count(DISTINCT publisher) < 2").
+		OrderBy("message_id"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reconciliation := &ReceiptReconciliation{
+		OnlyA: []string{},
+		OnlyB: []string{},
+	}
+	for rows.Next() {
+		var messageID string
+		var hasA, hasB bool
+		if err := rows.Scan(&messageID, &hasA, &hasB); err != nil {
+			return nil, err
+		}
+		if hasA {
+			reconciliation.OnlyA = append(reconciliation.OnlyA, messageID)
+		} else if hasB {
+			reconciliation.OnlyB = append(reconciliation.OnlyB, messageID)
+		}
+	}
+	return reconciliation, rows.Err()
+}
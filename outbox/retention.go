@@ -0,0 +1,68 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	sq "github.com/elgris/sqrl"
+	"github.com/pentops/sqrlx.go/sqrlx"
+)
+
+// RetentionPolicy is what happens to a destination's messages once they
+// are acked. Destinations without a policy are archived and kept forever
+// when the sender has an ArchiveTable, and deleted otherwise.
+type RetentionPolicy struct {
+	// Deletes messages on delivery. Only relevant with an ArchiveTable.
+	Delete bool
+
+	// How long archived messages are kept, by their CreatedAtColumn, before
+	// PruneArchive deletes them. Zero keeps them forever.
+	ArchiveFor time.Duration
+}
+
+func (ss *NamedSender) deletedDestinations() []string {
+	deleted := []string{}
+	for destination, policy := range ss.Retention {
+		if policy.Delete {
+			deleted = append(deleted, destination)
+		}
+	}
+	sort.Strings(deleted)
+	return deleted
+}
+
+// PruneArchive deletes archived messages which are older than their
+// destination's ArchiveFor, for a periodic cleanup job.
+func (ss *NamedSender) PruneArchive(ctx context.Context, tx sqrlx.Transaction, now time.Time) (int64, error) {
+	if ss.ArchiveTable == "" || ss.CreatedAtColumn == "" {
+		return 0, fmt.Errorf("%w: PruneArchive needs an ArchiveTable and CreatedAtColumn", ErrUnsupportedSender)
+	}
+
+	destinations := make([]string, 0, len(ss.Retention))
+	for destination := range ss.Retention {
+		destinations = append(destinations, destination)
+	}
+	sort.Strings(destinations)
+
+	var pruned int64
+	for _, destination := range destinations {
+		policy := ss.Retention[destination]
+		if policy.Delete || policy.ArchiveFor <= 0 {
+			continue
+		}
+		result, err := tx.Delete(ctx, sq.Delete(ss.ArchiveTable).
+			Where(sq.Eq{ss.DestinationColumn: destination}).
+			Where(sq.Lt{ss.CreatedAtColumn: now.Add(-policy.ArchiveFor)}))
+		if err != nil {
+			return pruned, err
+		}
+		count, err := result.RowsAffected()
+		if err != nil {
+			return pruned, err
+		}
+		pruned += count
+	}
+	return pruned, nil
+}
@@ -0,0 +1,139 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	sq "github.com/elgris/sqrl"
+	"github.com/pentops/sqrlx.go/sqrlx"
+)
+
+// SchemaColumn is a column as the database reports it.
+type SchemaColumn struct {
+	Table    string
+	Column   string
+	DataType string
+}
+
+// expectedColumns is every column the sender is configured to use, by
+// table.
+func (ss *NamedSender) expectedColumns() map[string][]string {
+	outboxColumns := []string{ss.IDColumn, ss.DestinationColumn, ss.HeadersColumn, ss.DataColumn}
+	for _, column := range []string{
+		ss.AggregateTypeColumn,
+		ss.AggregateIDColumn,
+		ss.AggregateSequenceColumn,
+		ss.RegionColumn,
+		ss.CompactionKeyColumn,
+		ss.PriorityColumn,
+		ss.CreatedAtColumn,
+		ss.DeliveredAtColumn,
+	} {
+		if column != "" {
+			outboxColumns = append(outboxColumns, column)
+		}
+	}
+
+	expected := map[string][]string{
+		ss.TableName: outboxColumns,
+	}
+	if ss.ArchiveTable != "" {
+		expected[ss.ArchiveTable] = outboxColumns
+	}
+	if ss.SequenceTable != "" {
+		expected[ss.SequenceTable] = []string{"aggregate_type", "aggregate_id", "sequence"}
+	}
+	if ss.ReceiptTable != "" {
+		expected[ss.ReceiptTable] = []string{"message_id", "destination", "publisher", "external_id", "detail", "delivered_at"}
+	}
+	return expected
+}
+
+// SchemaColumns reads the columns of the tables the sender uses, from the
+// current search path, sorted by table and column. Table names are matched
+// unqualified.
+func (ss *NamedSender) SchemaColumns(ctx context.Context, tx sqrlx.Transaction) ([]*SchemaColumn, error) {
+	tables := []string{}
+	for table := range ss.expectedColumns() {
+		tables = append(tables, table)
+	}
+
+	rows, err := tx.Select(ctx, sq.Select("table_name", "column_name", "data_type").
+		From("information_schema.columns").
+		Where("table_schema = ANY(current_schemas(false))").
+		Where(sq.Eq{"table_name": tables}).
+		OrderBy("table_name", "column_name"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := []*SchemaColumn{}
+	for rows.Next() {
+		column := &SchemaColumn{}
+		if err := rows.Scan(&column.Table, &column.Column, &column.DataType); err != nil {
+			return nil, err
+		}
+		columns = append(columns, column)
+	}
+	return columns, rows.Err()
+}
+
+// CheckSchema returns a SchemaError, matching ErrSchemaMismatch, listing
+// each configured column missing from the database, or nil when the schema
+// matches the sender.
+func (ss *NamedSender) CheckSchema(ctx context.Context, tx sqrlx.Transaction) error {
+	columns, err := ss.SchemaColumns(ctx, tx)
+	if err != nil {
+		return err
+	}
+	found := map[string]bool{}
+	for _, column := range columns {
+		found[column.Table+"."+column.Column] = true
+	}
+
+	missing := []string{}
+	for table, expected := range ss.expectedColumns() {
+		for _, column := range expected {
+			if !found[table+"."+column] {
+				missing = append(missing, table+"."+column)
+			}
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	sort.Strings(missing)
+	return &SchemaError{Missing: missing}
+}
+
+// DiffSchema compares SchemaColumns from two databases, e.g. staging and
+// production, describing each column which is missing or typed differently
+// in b.
+func DiffSchema(a []*SchemaColumn, b []*SchemaColumn) []string {
+	inB := map[string]*SchemaColumn{}
+	for _, column := range b {
+		inB[column.Table+"."+column.Column] = column
+	}
+	inA := map[string]bool{}
+
+	problems := []string{}
+	for _, column := range a {
+		key := column.Table + "." + column.Column
+		inA[key] = true
+		other, ok := inB[key]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s only in a", key))
+		} else if other.DataType != column.DataType {
+			problems = append(problems, fmt.Sprintf("%s is %s in a and %s in b", key, column.DataType, other.DataType))
+		}
+	}
+	for _, column := range b {
+		if key := column.Table + "." + column.Column; !inA[key] {
+			problems = append(problems, fmt.Sprintf("%s only in b", key))
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
@@ -0,0 +1,74 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	sq "github.com/elgris/sqrl"
+	"github.com/pentops/outbox.pg.go/internal/fakedb"
+	"github.com/pentops/sqrlx.go/sqrlx"
+)
+
+func TestCheckSchema(t *testing.T) {
+	sender := NewNamedSender(DefaultConfig())
+	sender.AggregateSequenceColumn = "aggregate_sequence"
+
+	for _, tc := range []struct {
+		name    string
+		columns []string
+		missing []string
+	}{
+		{name: "matches", columns: []string{"aggregate_sequence", "destination", "headers", "id", "message"}},
+		{name: "missing", columns: []string{"destination", "id"}, missing: []string{"outbox.aggregate_sequence", "outbox.headers", "outbox.message"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conn := fakedb.Open(func(query string, args []driver.NamedValue) (*fakedb.Result, error) {
+				if !strings.HasPrefix(query, "SELECT") {
+					return &fakedb.Result{}, nil
+				}
+				rows := [][]driver.Value{}
+				for _, column := range tc.columns {
+					rows = append(rows, []driver.Value{"outbox", column, "text"})
+				}
+				return &fakedb.Result{Columns: []string{"table_name", "column_name", "data_type"}, Rows: rows}, nil
+			})
+			db, err := sqrlx.New(conn.DB, sq.Dollar)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var checkErr error
+			if err := db.Transact(context.Background(), &sqrlx.TxOptions{
+				Isolation: sql.LevelReadCommitted,
+				ReadOnly:  true,
+			}, func(ctx context.Context, tx sqrlx.Transaction) error {
+				checkErr = sender.CheckSchema(ctx, tx)
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			if tc.missing == nil {
+				if checkErr != nil {
+					t.Fatalf("got %v for a matching schema", checkErr)
+				}
+				return
+			}
+			if !errors.Is(checkErr, ErrSchemaMismatch) {
+				t.Fatalf("got %v, want ErrSchemaMismatch", checkErr)
+			}
+			schemaErr := &SchemaError{}
+			if !errors.As(checkErr, &schemaErr) {
+				t.Fatalf("got %T, want a SchemaError", checkErr)
+			}
+			if !reflect.DeepEqual(schemaErr.Missing, tc.missing) {
+				t.Errorf("missing %v, want %v", schemaErr.Missing, tc.missing)
+			}
+		})
+	}
+}
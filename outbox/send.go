@@ -3,7 +3,11 @@ package outbox
 import (
 	"context"
 	"database/sql"
-	"net/url"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	sq "github.com/elgris/sqrl"
 	"github.com/google/uuid"
@@ -17,58 +21,427 @@ type OutboxMessage interface {
 	proto.Message
 }
 
+// AggregateMessage is implemented by messages which belong to a domain
+// aggregate, for senders configured with aggregate columns.
+type AggregateMessage interface {
+	OutboxMessage
+	MessagingAggregate() (aggregateType string, aggregateID string)
+}
+
 type Sender interface {
-	Send(ctx context.Context, tx sqrlx.Transaction, msg OutboxMessage) error
+	Send(ctx context.Context, tx sqrlx.Transaction, msg OutboxMessage, opts ...SendOption) error
 }
 
 var DefaultSender Sender
 
-func Send(ctx context.Context, tx sqrlx.Transaction, msg OutboxMessage) error {
-	return DefaultSender.Send(ctx, tx, msg)
+func Send(ctx context.Context, tx sqrlx.Transaction, msg OutboxMessage, opts ...SendOption) error {
+	return DefaultSender.Send(ctx, tx, msg, opts...)
 }
 
 func init() {
-	DefaultSender = &NamedSender{
-		TableName:         "outbox",
-		IDColumn:          "id",
-		HeadersColumn:     "headers",
-		DataColumn:        "message",
-		DestinationColumn: "destination",
-	}
+	DefaultSender = NewNamedSender(DefaultConfig())
 }
 
 type NamedSender struct {
-	TableName         string
-	IDColumn          string
-	HeadersColumn     string
-	DataColumn        string
-	DestinationColumn string
+	Config
+
+	// Optional, see SendForAggregate
+	SequenceTable string
+
+	// Optional, the home region of messages without a region header
+	Region string
+
+	// Optional, see RecordReceipts
+	ReceiptTable string
+
+	// Optional, an advisory lock key which pauses claims while a migration
+	// holds it, see LockForMigration
+	MigrationLockKey int64
+
+	// Optional, per destination, see RetentionPolicy
+	Retention map[string]RetentionPolicy
+
+	// Optional, sets the message-version header for messages which are not
+	// a VersionedMessage, e.g. ProtoPackageVersion
+	MessageVersion func(OutboxMessage) string
+
+	// Optional, when set the ID of messages with an idempotency-key header
+	// is derived from it, see DeterministicID.
+	IDNamespace uuid.UUID
+
+	// Messages per insert in SendStream, keep it under 65535 bind
+	// parameters, i.e. divided by the number of columns
+	StreamChunkSize int
+
+	// Optional, larger message bodies fail with ErrPayloadTooLarge
+	MaxPayloadBytes int
+
+	// Headers added to every message from the context of the send, where
+	// the message doesn't set them itself
+	HeaderExtractors []HeaderExtractor
+
+	// Checked in order before each message is written
+	Guards []SendGuard
+
+	// Optional, called for every message sent.
+	Observer SendObserver
+
+	// Optional, a pg_notify channel which receives the destination of each
+	// message when the transaction commits, see Subscriber.Wake
+	NotifyChannel string
+
+	// Optional, sqlcommenter key values, e.g. traceparent or the calling
+	// endpoint, appended as a comment to insert and claim statements so
+	// that load can be attributed in pg_stat_statements and logs
+	SQLComment func(ctx context.Context) map[string]string
+
+	layout atomic.Pointer[insertLayout]
 }
 
-func (ss *NamedSender) Send(ctx context.Context, tx sqrlx.Transaction, msg OutboxMessage) error {
-	msgBytes, err := proto.Marshal(msg)
+// NewDebeziumSender returns a sender using the table layout of the Debezium
+// outbox event router, so the table can be drained by logical replication.
+// The router's default route.by.field is aggregatetype, which holds the
+// destination unless the message is an AggregateMessage.
+func NewDebeziumSender(tableName string) *NamedSender {
+	return NewNamedSender(Config{
+		TableName:           tableName,
+		IDColumn:            "id",
+		HeadersColumn:       "headers",
+		DataColumn:          "payload",
+		DestinationColumn:   "type",
+		AggregateTypeColumn: "aggregatetype",
+		AggregateIDColumn:   "aggregateid",
+	})
+}
+
+// encode converts a proto message with the sender's options, then the
+// send options.
+func (ss *NamedSender) encode(msg OutboxMessage, opts ...SendOption) (*Raw, error) {
+	raw, err := newRaw(msg, ss.AnyPayload)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	if ss.Region != "" && raw.Headers.Get(RegionHeader) == "" {
+		raw.setHeader(RegionHeader, ss.Region)
+	}
+	if ss.MessageVersion != nil && raw.Headers.Get(MessageVersionHeader) == "" {
+		if version := ss.MessageVersion(msg); version != "" {
+			raw.setHeader(MessageVersionHeader, version)
+		}
+	}
+	applyOptions(raw, opts)
+	return raw, nil
+}
 
-	destination := msg.MessagingTopic()
+func (ss *NamedSender) Send(ctx context.Context, tx sqrlx.Transaction, msg OutboxMessage, opts ...SendOption) error {
+	_, err := ss.SendReturningID(ctx, tx, msg, opts...)
+	return err
+}
 
-	headers := &url.Values{}
-	for k, v := range msg.MessagingHeaders() {
-		headers.Add(k, v)
+func (ss *NamedSender) SendReturningID(ctx context.Context, tx sqrlx.Transaction, msg OutboxMessage, opts ...SendOption) (string, error) {
+	start := time.Now()
+	raw, err := ss.encode(msg, opts...)
+	if err != nil {
+		ss.observe(start, err, &Raw{Destination: msg.MessagingTopic()})
+		return "", err
 	}
+	return ss.sendRaw(ctx, tx, raw, start)
+}
 
-	id := uuid.NewString()
+// SendTo sends the message to destination in place of its MessagingTopic,
+// e.g. for shadow or per-tenant topics.
+func (ss *NamedSender) SendTo(ctx context.Context, tx sqrlx.Transaction, destination string, msg OutboxMessage, opts ...SendOption) error {
+	start := time.Now()
+	raw, err := ss.encode(msg, opts...)
+	if err != nil {
+		ss.observe(start, err, &Raw{Destination: destination})
+		return err
+	}
+	raw.Destination = destination
+	_, err = ss.sendRaw(ctx, tx, raw, start)
+	return err
+}
 
-	_, err = tx.Insert(ctx, sq.Insert(ss.TableName).
-		Columns(ss.IDColumn, ss.DestinationColumn, ss.HeadersColumn, ss.DataColumn).
-		Values(id, destination, headers.Encode(), msgBytes))
+// SendBatch writes all of the messages with a single multi-row insert.
+// Messages which can't be encoded or are refused by a guard are reported
+// together in a BatchError.
+func (ss *NamedSender) SendBatch(ctx context.Context, tx sqrlx.Transaction, msgs ...OutboxMessage) error {
+	start := time.Now()
+	batchErr := &BatchError{Size: len(msgs)}
+	raws := make([]*Raw, len(msgs))
+	for idx, msg := range msgs {
+		raw, err := ss.encode(msg)
+		if err != nil {
+			batchErr.add(idx, nil, msg.MessagingTopic(), err)
+			raw = &Raw{Destination: msg.MessagingTopic()}
+		}
+		raws[idx] = raw
+	}
+	if len(batchErr.Failures) > 0 {
+		ss.observeBatch(start, batchErr, raws)
+		return batchErr
+	}
+	return ss.sendRawBatch(ctx, tx, raws, start)
+}
 
+func (ss *NamedSender) SendRaw(ctx context.Context, tx sqrlx.Transaction, raw *Raw) error {
+	_, err := ss.SendRawReturningID(ctx, tx, raw)
 	return err
 }
 
+func (ss *NamedSender) SendRawReturningID(ctx context.Context, tx sqrlx.Transaction, raw *Raw) (string, error) {
+	return ss.sendRaw(ctx, tx, raw, time.Now())
+}
+
+// sendRaw writes one message, observing it with the time since start.
+func (ss *NamedSender) sendRaw(ctx context.Context, tx sqrlx.Transaction, raw *Raw, start time.Time) (id string, err error) {
+	defer func() {
+		ss.observe(start, err, raw)
+	}()
+	if err := requireTransaction(tx); err != nil {
+		return "", err
+	}
+	raw = ss.withContextHeaders(ctx, raw)
+	if err := ss.checkGuards(ctx, raw); err != nil {
+		return "", err
+	}
+	raws := []*Raw{raw}
+	if _, err := ss.compact(ctx, tx, raws); err != nil {
+		return "", err
+	}
+	layout := ss.insertLayout()
+	id, values := ss.appendRow(make([]interface{}, 0, len(layout.columns)), raw)
+	statement := ss.withComment(ctx, layout.statement, raw.Destination)
+	if _, err := tx.Insert(ctx, sq.Expr(statement, values...)); err != nil {
+		return "", err
+	}
+	if err := ss.notify(ctx, tx, raws); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// SendRawBatch writes all of the messages with a single multi-row insert.
+func (ss *NamedSender) SendRawBatch(ctx context.Context, tx sqrlx.Transaction, raws ...*Raw) error {
+	return ss.sendRawBatch(ctx, tx, raws, time.Now())
+}
+
+// sendRawBatch writes the messages, observing each with the time since
+// start.
+func (ss *NamedSender) sendRawBatch(ctx context.Context, tx sqrlx.Transaction, raws []*Raw, start time.Time) (err error) {
+	if len(raws) == 0 {
+		return requireTransaction(tx)
+	}
+	sent := raws
+	defer func() {
+		ss.observeBatch(start, err, sent)
+	}()
+	if err := requireTransaction(tx); err != nil {
+		return err
+	}
+	if len(ss.HeaderExtractors) > 0 {
+		withHeaders := make([]*Raw, 0, len(raws))
+		for _, raw := range raws {
+			withHeaders = append(withHeaders, ss.withContextHeaders(ctx, raw))
+		}
+		raws = withHeaders
+	}
+
+	batchErr := &BatchError{Size: len(raws)}
+	for idx, raw := range raws {
+		if err := ss.checkGuards(ctx, raw); err != nil {
+			batchErr.add(idx, raw, raw.Destination, err)
+		}
+	}
+	if len(batchErr.Failures) > 0 {
+		return batchErr
+	}
+	raws, err = ss.compact(ctx, tx, raws)
+	if err != nil {
+		return err
+	}
+
+	layout := ss.insertLayout()
+	values := make([]interface{}, 0, len(raws)*len(layout.columns))
+	for _, raw := range raws {
+		_, values = ss.appendRow(values, raw)
+	}
+
+	statement := layout.statement
+	if len(raws) > 1 {
+		statement += strings.Repeat(", "+layout.placeholders, len(raws)-1)
+	}
+
+	statement = ss.withComment(ctx, statement, batchDestination(raws))
+	if _, err := tx.Insert(ctx, sq.Expr(statement, values...)); err != nil {
+		return err
+	}
+	return ss.notify(ctx, tx, raws)
+}
+
+func (ss *NamedSender) checkGuards(ctx context.Context, raw *Raw) error {
+	if ss.MaxPayloadBytes > 0 && len(raw.Body) > ss.MaxPayloadBytes {
+		return fmt.Errorf("%w: %d bytes for %s, the limit is %d", ErrPayloadTooLarge, len(raw.Body), raw.Destination, ss.MaxPayloadBytes)
+	}
+	for _, guard := range ss.Guards {
+		if err := guard.CheckSend(ctx, raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// observeBatch observes each message of a batch, with its own failure
+// from a BatchError, or the batch's error.
+func (ss *NamedSender) observeBatch(start time.Time, err error, raws []*Raw) {
+	if ss.Observer == nil {
+		return
+	}
+	failures := map[int]error{}
+	var batchErr *BatchError
+	if errors.As(err, &batchErr) {
+		for _, failure := range batchErr.Failures {
+			failures[failure.Index] = failure.Err
+		}
+	}
+	for idx, raw := range raws {
+		msgErr := err
+		if failure, ok := failures[idx]; ok {
+			msgErr = failure
+		}
+		ss.observe(start, msgErr, raw)
+	}
+}
+
+func (ss *NamedSender) observe(start time.Time, err error, raw *Raw) {
+	if ss.Observer == nil {
+		return
+	}
+	ss.Observer.ObserveSend(SendObservation{
+		Destination:  raw.Destination,
+		PayloadBytes: len(raw.Body),
+		Duration:     time.Since(start),
+		Err:          err,
+	})
+}
+
+// insertLayout is the column list and single row INSERT of a Config,
+// cached on the sender until its Config changes.
+type insertLayout struct {
+	config       Config
+	columns      []string
+	placeholders string
+	statement    string
+}
+
+// insertLayout returns the columns written by appendRow, in the same order.
+func (ss *NamedSender) insertLayout() *insertLayout {
+	if layout := ss.layout.Load(); layout != nil && layout.config == ss.Config {
+		return layout
+	}
+
+	columns := []string{ss.IDColumn, ss.DestinationColumn, ss.HeadersColumn, ss.DataColumn}
+	if ss.AggregateTypeColumn != "" {
+		columns = append(columns, ss.AggregateTypeColumn)
+	}
+	if ss.AggregateIDColumn != "" {
+		columns = append(columns, ss.AggregateIDColumn)
+	}
+	if ss.RegionColumn != "" {
+		columns = append(columns, ss.RegionColumn)
+	}
+	if ss.CompactionKeyColumn != "" {
+		columns = append(columns, ss.CompactionKeyColumn)
+	}
+	if ss.PriorityColumn != "" {
+		columns = append(columns, ss.PriorityColumn)
+	}
+	if ss.AggregateSequenceColumn != "" {
+		columns = append(columns, ss.AggregateSequenceColumn)
+	}
+
+	placeholders := "(?" + strings.Repeat(", ?", len(columns)-1) + ")"
+	layout := &insertLayout{
+		config:       ss.Config,
+		columns:      columns,
+		placeholders: placeholders,
+		statement:    "INSERT INTO " + ss.TableName + " (" + strings.Join(columns, ", ") + ") VALUES " + placeholders,
+	}
+	ss.layout.Store(layout)
+	return layout
+}
+
+func (ss *NamedSender) messageID(raw *Raw) string {
+	if raw.ID != "" {
+		return raw.ID
+	}
+	if ss.IDNamespace != uuid.Nil {
+		if key := raw.Headers.Get(IdempotencyKeyHeader); key != "" {
+			return DeterministicID(ss.IDNamespace, raw.Destination, key)
+		}
+	}
+	return uuid.NewString()
+}
+
+// appendRow appends the values of insertLayout's columns for raw,
+// returning the message ID.
+func (ss *NamedSender) appendRow(values []interface{}, raw *Raw) (string, []interface{}) {
+	id := ss.messageID(raw)
+	values = append(values, id, raw.Destination, ss.HeaderEncoding.Encode(raw.headers()), raw.Body)
+
+	if ss.AggregateTypeColumn != "" || ss.AggregateIDColumn != "" {
+		aggregateType, aggregateID := raw.Destination, id
+		if raw.AggregateType != "" || raw.AggregateID != "" {
+			aggregateType, aggregateID = raw.AggregateType, raw.AggregateID
+		}
+		if ss.AggregateTypeColumn != "" {
+			values = append(values, aggregateType)
+		}
+		if ss.AggregateIDColumn != "" {
+			values = append(values, aggregateID)
+		}
+	}
+
+	if ss.RegionColumn != "" {
+		var region interface{}
+		if header := raw.Headers.Get(RegionHeader); header != "" {
+			region = header
+		}
+		values = append(values, region)
+	}
+
+	if ss.CompactionKeyColumn != "" {
+		var key interface{}
+		if compactionKey := raw.Headers.Get(CompactionKeyHeader); compactionKey != "" {
+			key = compactionKey
+		}
+		values = append(values, key)
+	}
+
+	if ss.PriorityColumn != "" {
+		values = append(values, raw.Priority)
+	}
+
+	if ss.AggregateSequenceColumn != "" {
+		var sequence interface{}
+		if raw.AggregateSequence != 0 {
+			sequence = raw.AggregateSequence
+		}
+		values = append(values, sequence)
+	}
+
+	return id, values
+}
+
 type DBPublisher struct {
 	db sqrlx.Transactor
+
+	// Optional, Publish splits larger calls into transactions of at most
+	// MaxMessages messages or MaxBytes of encoded payload. Each chunk
+	// commits on its own, use PublishAtomic where all messages must be sent
+	// together.
+	MaxMessages int
+	MaxBytes    int
 }
 
 func NewDBPublisher(conn sqrlx.Connection) (*DBPublisher, error) {
@@ -82,17 +455,55 @@ func NewDBPublisher(conn sqrlx.Connection) (*DBPublisher, error) {
 	}, nil
 }
 
+// Publish sends the messages, in one transaction unless MaxMessages or
+// MaxBytes split them. When a message fails, the error is a BatchError
+// giving its position, and the chunks before it have been committed.
 func (p *DBPublisher) Publish(ctx context.Context, msgs ...OutboxMessage) error {
-	return p.db.Transact(ctx, &sqrlx.TxOptions{
+	start := 0
+	size := 0
+	for idx, msg := range msgs {
+		msgSize := proto.Size(msg)
+		full := (p.MaxMessages > 0 && idx-start >= p.MaxMessages) ||
+			(p.MaxBytes > 0 && idx > start && size+msgSize > p.MaxBytes)
+		if full {
+			if err := p.publish(ctx, msgs, start, idx); err != nil {
+				return err
+			}
+			start, size = idx, 0
+		}
+		size += msgSize
+	}
+	return p.publish(ctx, msgs, start, len(msgs))
+}
+
+// PublishAtomic sends all of the messages in one transaction, ignoring
+// MaxMessages and MaxBytes.
+func (p *DBPublisher) PublishAtomic(ctx context.Context, msgs ...OutboxMessage) error {
+	return p.publish(ctx, msgs, 0, len(msgs))
+}
+
+func (p *DBPublisher) publish(ctx context.Context, msgs []OutboxMessage, from, to int) error {
+	// the send error is wrapped after Transact, which only recognises
+	// retryable errors when they are returned unwrapped
+	failedIdx := -1
+	err := p.db.Transact(ctx, &sqrlx.TxOptions{
 		ReadOnly:  false,
 		Retryable: true,
 		Isolation: sql.LevelReadCommitted,
 	}, func(ctx context.Context, tx sqrlx.Transaction) error {
-		for _, msg := range msgs {
-			if err := Send(ctx, tx, msg); err != nil {
+		failedIdx = -1
+		for idx := from; idx < to; idx++ {
+			if err := Send(ctx, tx, msgs[idx]); err != nil {
+				failedIdx = idx
 				return err
 			}
 		}
 		return nil
 	})
+	if err != nil && failedIdx >= 0 {
+		batchErr := &BatchError{Size: len(msgs)}
+		batchErr.add(failedIdx, nil, msgs[failedIdx].MessagingTopic(), err)
+		return batchErr
+	}
+	return err
 }
@@ -0,0 +1,109 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"testing"
+
+	"github.com/pentops/sqrlx.go/sqrlx"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type testMessage struct {
+	*wrapperspb.StringValue
+	topic   string
+	headers map[string]string
+}
+
+func (msg *testMessage) MessagingTopic() string {
+	return msg.topic
+}
+
+func (msg *testMessage) MessagingHeaders() map[string]string {
+	return msg.headers
+}
+
+// discardTx stands in for the database in benchmarks of the send path,
+// accepting every statement.
+type discardTx struct {
+	sqrlx.Transaction
+}
+
+func (discardTx) Insert(context.Context, sqrlx.Sqlizer) (sql.Result, error) {
+	return driver.RowsAffected(1), nil
+}
+
+func (discardTx) Exec(context.Context, sqrlx.Sqlizer) (sql.Result, error) {
+	return driver.RowsAffected(1), nil
+}
+
+func benchSenders() map[string]*NamedSender {
+	full := NewNamedSender(DefaultConfig())
+	full.AggregateTypeColumn = "aggregate_type"
+	full.AggregateIDColumn = "aggregate_id"
+	full.RegionColumn = "region"
+	full.PriorityColumn = "priority"
+	full.AggregateSequenceColumn = "aggregate_sequence"
+	return map[string]*NamedSender{
+		"default": NewNamedSender(DefaultConfig()),
+		"columns": full,
+	}
+}
+
+func benchMessage(idx int) *testMessage {
+	return &testMessage{
+		StringValue: wrapperspb.String(fmt.Sprintf("payload %d", idx)),
+		topic:       "bench.v1.Topic",
+		headers: map[string]string{
+			GRPCServiceHeader: "/bench.v1.Topic/Event",
+			"x-request-id":    "6f1c2a9e-4d1b-4c6e-9f0a-3b2d1e0c9a8b",
+		},
+	}
+}
+
+func BenchmarkSend(b *testing.B) {
+	ctx := context.Background()
+	msg := benchMessage(0)
+	for name, sender := range benchSenders() {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := sender.Send(ctx, discardTx{}, msg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSendBatch(b *testing.B) {
+	ctx := context.Background()
+	msgs := make([]OutboxMessage, 100)
+	for idx := range msgs {
+		msgs[idx] = benchMessage(idx)
+	}
+	for name, sender := range benchSenders() {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := sender.SendBatch(ctx, discardTx{}, msgs...); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkEncodeHeaders(b *testing.B) {
+	msg := benchMessage(0)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		raw, err := NewRaw(msg)
+		if err != nil {
+			b.Fatal(err)
+		}
+		_ = HeaderEncodingURL.Encode(raw.headers())
+	}
+}
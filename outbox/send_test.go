@@ -0,0 +1,99 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"strings"
+	"testing"
+
+	"github.com/pentops/sqrlx.go/sqrlx"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// recordingTx keeps the statements it is given, accepting every one.
+type recordingTx struct {
+	sqrlx.Transaction
+	statements []string
+	args       [][]interface{}
+}
+
+func (tx *recordingTx) record(query sqrlx.Sqlizer) (sql.Result, error) {
+	statement, args, err := query.ToSql()
+	if err != nil {
+		return nil, err
+	}
+	tx.statements = append(tx.statements, statement)
+	tx.args = append(tx.args, args)
+	return driver.RowsAffected(1), nil
+}
+
+func (tx *recordingTx) Insert(_ context.Context, query sqrlx.Sqlizer) (sql.Result, error) {
+	return tx.record(query)
+}
+
+func (tx *recordingTx) Exec(_ context.Context, query sqrlx.Sqlizer) (sql.Result, error) {
+	return tx.record(query)
+}
+
+func (tx *recordingTx) Update(_ context.Context, query sqrlx.Sqlizer) (sql.Result, error) {
+	return tx.record(query)
+}
+
+func (tx *recordingTx) Delete(_ context.Context, query sqrlx.Sqlizer) (sql.Result, error) {
+	return tx.record(query)
+}
+
+func TestInsertLayout(t *testing.T) {
+	ctx := context.Background()
+	sender := NewNamedSender(DefaultConfig())
+	msg := benchMessage(0)
+
+	tx := &recordingTx{}
+	if err := sender.Send(ctx, tx, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	// a changed Config rebuilds the cached layout
+	sender.RegionColumn = "region"
+	sender.PriorityColumn = "priority"
+	if err := sender.SendBatch(ctx, tx, msg, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	for idx, want := range []struct {
+		statement string
+		args      int
+	}{
+		{"INSERT INTO outbox (id, destination, headers, message) VALUES (?, ?, ?, ?)", 4},
+		{"INSERT INTO outbox (id, destination, headers, message, region, priority) VALUES (?, ?, ?, ?, ?, ?), (?, ?, ?, ?, ?, ?)", 12},
+	} {
+		if got := tx.statements[idx]; got != want.statement {
+			t.Errorf("statement %d: got %q, want %q", idx, got, want.statement)
+		}
+		if got := len(tx.args[idx]); got != want.args {
+			t.Errorf("statement %d: got %d args, want %d", idx, got, want.args)
+		}
+		if got := strings.Count(tx.statements[idx], "?"); got != len(tx.args[idx]) {
+			t.Errorf("statement %d: %d placeholders for %d args", idx, got, len(tx.args[idx]))
+		}
+	}
+}
+
+func TestMessageHeadersAreIndependent(t *testing.T) {
+	raw, err := NewRaw(&testMessage{
+		StringValue: wrapperspb.String("payload"),
+		topic:       "test.v1.Topic",
+		headers:     map[string]string{"a": "1", "b": "2", "c": "3"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw.Headers.Add("a", "4")
+	raw.Headers.Add("b", "5")
+
+	want := "a=1&a=4&b=2&b=5&c=3"
+	if got := raw.Headers.Encode(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,87 @@
+package outbox
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// SequenceGap reports a delivery whose aggregate sequence did not follow on
+// from the last one seen for the aggregate.
+type SequenceGap struct {
+	AggregateType string
+	AggregateID   string
+	Expected      uint64
+	Received      uint64
+}
+
+func (gap SequenceGap) String() string {
+	return fmt.Sprintf("%s %s: expected sequence %d, received %d", gap.AggregateType, gap.AggregateID, gap.Expected, gap.Received)
+}
+
+type aggregateKey struct {
+	aggregateType string
+	aggregateID   string
+}
+
+// SequenceTracker checks the headers set by SendForAggregate on received
+// messages, reporting missing and out of order sequence numbers. It keeps
+// the last sequence of every aggregate it has seen in memory.
+type SequenceTracker struct {
+	last map[aggregateKey]uint64
+}
+
+func NewSequenceTracker() *SequenceTracker {
+	return &SequenceTracker{
+		last: map[aggregateKey]uint64{},
+	}
+}
+
+// Observe records the headers of a received message. Messages without an
+// aggregate sequence are ignored. A redelivered message, with a sequence at
+// or below the last seen, is not a gap. The first message seen for an
+// aggregate is a gap unless it is sequence 1.
+func (st *SequenceTracker) Observe(headers url.Values) (*SequenceGap, error) {
+	sequenceHeader := headers.Get(AggregateSequenceHeader)
+	if sequenceHeader == "" {
+		return nil, nil
+	}
+	sequence, err := strconv.ParseUint(sequenceHeader, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s header: %w", AggregateSequenceHeader, err)
+	}
+
+	key := aggregateKey{
+		aggregateType: headers.Get(AggregateTypeHeader),
+		aggregateID:   headers.Get(AggregateIDHeader),
+	}
+	last := st.last[key]
+	if sequence <= last {
+		return nil, nil
+	}
+	st.last[key] = sequence
+	if sequence == last+1 {
+		return nil, nil
+	}
+	return &SequenceGap{
+		AggregateType: key.aggregateType,
+		AggregateID:   key.aggregateID,
+		Expected:      last + 1,
+		Received:      sequence,
+	}, nil
+}
+
+// Check observes each delivery in order, returning every gap found.
+func (st *SequenceTracker) Check(deliveries []*Delivery) ([]SequenceGap, error) {
+	gaps := []SequenceGap{}
+	for _, delivery := range deliveries {
+		gap, err := st.Observe(delivery.Headers)
+		if err != nil {
+			return nil, fmt.Errorf("message %s: %w", delivery.ID, err)
+		}
+		if gap != nil {
+			gaps = append(gaps, *gap)
+		}
+	}
+	return gaps, nil
+}
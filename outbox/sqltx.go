@@ -0,0 +1,59 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+
+	sq "github.com/elgris/sqrl"
+	"github.com/pentops/sqrlx.go/sqrlx"
+)
+
+// FromSQLTx adapts a database/sql transaction, e.g. the one given to sqlc's
+// Queries.WithTx, for Send and the other sqrlx based functions, so that
+// messages commit with the caller's queries:
+//
+//	tx, err := db.BeginTx(ctx, nil)
+//	...
+//	if err := queries.WithTx(tx).CreateOrder(ctx, params); err != nil {
+//		return err
+//	}
+//	outboxTx, err := outbox.FromSQLTx(tx)
+//	...
+//	if err := outbox.Send(ctx, outboxTx, msg); err != nil {
+//		return err
+//	}
+//	return tx.Commit()
+//
+// The caller commits or rolls back, and sqrlx retries don't apply. Queries
+// use Postgres $n placeholders.
+func FromSQLTx(tx *sql.Tx) (sqrlx.Transaction, error) {
+	if tx == nil {
+		return nil, ErrNoTransaction
+	}
+	wrapper, err := sqrlx.NewWithCommander(callerTx{Tx: tx}, sq.Dollar)
+	if err != nil {
+		return nil, err
+	}
+	return sqrlx.Tx{
+		Commander: wrapper.Commander,
+		TxExtras:  callerTx{Tx: tx},
+	}, nil
+}
+
+// callerTx runs queries directly on the caller's transaction, as a
+// sqrlx.Connection which can't begin another.
+type callerTx struct {
+	*sql.Tx
+}
+
+func (tx callerTx) BeginTx(context.Context, *sql.TxOptions) (*sql.Tx, error) {
+	return nil, ErrCallerTransaction
+}
+
+func (tx callerTx) Reset(context.Context) error {
+	return ErrCallerTransaction
+}
+
+func (tx callerTx) PrepareRaw(ctx context.Context, statement string) (*sql.Stmt, error) {
+	return tx.PrepareContext(ctx, statement)
+}
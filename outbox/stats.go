@@ -0,0 +1,105 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	sq "github.com/elgris/sqrl"
+	"github.com/pentops/sqrlx.go/sqrlx"
+)
+
+// DestinationStats describes the messages waiting in the outbox for one
+// destination.
+type DestinationStats struct {
+	Destination string
+	Messages    uint64
+
+	// Total size of the stored message bodies
+	Bytes uint64
+
+	// Creation time of the oldest message, zero unless the sender has a
+	// CreatedAtColumn
+	Oldest time.Time
+}
+
+// Stats counts the messages and body bytes in the outbox table by
+// destination.
+func (ss *NamedSender) Stats(ctx context.Context, tx sqrlx.Transaction) ([]*DestinationStats, error) {
+	columns := []string{ss.DestinationColumn, "count(*)", "coalesce(sum(octet_length(" + ss.DataColumn + ")), 0)"}
+	if ss.CreatedAtColumn != "" {
+		columns = append(columns, "min("+ss.CreatedAtColumn+")")
+	}
+	rows, err := tx.Select(ctx, ss.undelivered(sq.Select(columns...).
+		From(ss.TableName).
+		GroupBy(ss.DestinationColumn)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := []*DestinationStats{}
+	for rows.Next() {
+		destStats := &DestinationStats{}
+		var oldest sql.NullTime
+		dest := []interface{}{&destStats.Destination, &destStats.Messages, &destStats.Bytes}
+		if ss.CreatedAtColumn != "" {
+			dest = append(dest, &oldest)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		destStats.Oldest = oldest.Time
+		stats = append(stats, destStats)
+	}
+	return stats, rows.Err()
+}
+
+// DestinationActivity is when a destination last had a message enqueued
+// and delivered, to spot producers which have silently stopped.
+type DestinationActivity struct {
+	Destination   string
+	LastEnqueued  time.Time
+	LastDelivered time.Time
+}
+
+// Activity reads the last enqueue time per destination from the
+// CreatedAtColumn of the outbox and ArchiveTable, and the last delivery
+// from ReceiptTable. Without an archive only undelivered messages count as
+// enqueued, and without receipts LastDelivered is zero.
+func (ss *NamedSender) Activity(ctx context.Context, tx sqrlx.Transaction) ([]*DestinationActivity, error) {
+	if ss.CreatedAtColumn == "" {
+		return nil, fmt.Errorf("%w: Activity needs a CreatedAtColumn", ErrUnsupportedSender)
+	}
+
+	sources := []string{
+		"SELECT " + ss.DestinationColumn + " AS destination, " + ss.CreatedAtColumn + " AS enqueued, NULL::timestamptz AS delivered FROM " + ss.TableName,
+	}
+	if ss.ArchiveTable != "" {
+		sources = append(sources, "SELECT "+ss.DestinationColumn+", "+ss.CreatedAtColumn+", NULL::timestamptz FROM "+ss.ArchiveTable)
+	}
+	if ss.ReceiptTable != "" {
+		sources = append(sources, "SELECT destination, NULL::timestamptz, delivered_at FROM "+ss.ReceiptTable)
+	}
+
+	rows, err := tx.Query(ctx, sq.Expr("SELECT destination, max(enqueued), max(delivered) FROM ("+strings.Join(sources, " UNION ALL ")+") activity GROUP BY destination"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	activity := []*DestinationActivity{}
+	for rows.Next() {
+		var enqueued, delivered sql.NullTime
+		destActivity := &DestinationActivity{}
+		if err := rows.Scan(&destActivity.Destination, &enqueued, &delivered); err != nil {
+			return nil, err
+		}
+		destActivity.LastEnqueued = enqueued.Time
+		destActivity.LastDelivered = delivered.Time
+		activity = append(activity, destActivity)
+	}
+	return activity, rows.Err()
+}
@@ -0,0 +1,51 @@
+package outbox
+
+import (
+	"context"
+
+	"github.com/pentops/sqrlx.go/sqrlx"
+)
+
+// DefaultStreamChunkSize is the number of messages per insert in SendStream
+// when NamedSender.StreamChunkSize is not set.
+const DefaultStreamChunkSize = 500
+
+// SendStream sends every message from next, which returns false once there
+// are no more, in multi-row inserts of StreamChunkSize messages. Only one
+// chunk is held in memory, so ETL jobs can enqueue straight from a cursor.
+func (ss *NamedSender) SendStream(ctx context.Context, tx sqrlx.Transaction, next func() (OutboxMessage, bool, error)) error {
+	if err := requireTransaction(tx); err != nil {
+		return err
+	}
+
+	chunkSize := ss.StreamChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultStreamChunkSize
+	}
+
+	chunk := make([]*Raw, 0, chunkSize)
+	for {
+		msg, ok, err := next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+
+		raw, err := ss.encode(msg)
+		if err != nil {
+			return err
+		}
+		chunk = append(chunk, raw)
+
+		if len(chunk) == chunkSize {
+			if err := ss.SendRawBatch(ctx, tx, chunk...); err != nil {
+				return err
+			}
+			chunk = chunk[:0]
+		}
+	}
+
+	return ss.SendRawBatch(ctx, tx, chunk...)
+}
@@ -0,0 +1,201 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	sq "github.com/elgris/sqrl"
+	"github.com/pentops/sqrlx.go/sqrlx"
+)
+
+// notify signals NotifyChannel once per destination. Postgres holds the
+// notification until commit, and drops it on rollback.
+func (ss *NamedSender) notify(ctx context.Context, tx sqrlx.Transaction, raws []*Raw) error {
+	if ss.NotifyChannel == "" {
+		return nil
+	}
+	notified := map[string]bool{}
+	for _, raw := range raws {
+		if notified[raw.Destination] {
+			continue
+		}
+		notified[raw.Destination] = true
+		if _, err := tx.Exec(ctx, sq.Expr("SELECT pg_notify(?, ?)", ss.NotifyChannel, raw.Destination)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Subscriber consumes messages for a destination in-process, for small
+// deployments without a broker or relay. Each batch is read and decoded in
+// full before any of it is handed to the channel, so a batch which fails to
+// read delivers nothing. Messages are deleted once received, and redelivered
+// if the process stops before the claim commits.
+type Subscriber struct {
+	db     sqrlx.Transactor
+	sender *NamedSender
+
+	// Time between reads of the table when it is empty
+	PollInterval time.Duration
+
+	BatchSize uint64
+
+	// Optional, triggers an immediate read, e.g. from a LISTEN on the
+	// sender's NotifyChannel. database/sql can't receive notifications, so
+	// the listener has to come from the driver, e.g. pq.Listener or
+	// pgx.Conn.WaitForNotification.
+	Wake <-chan struct{}
+
+	// Optional, called when a read fails. The subscription carries on
+	// after PollInterval.
+	OnError func(error)
+
+	// Consecutive data errors (see IsDataError) after which the
+	// subscription enters safe mode: it stops, closing the channel, and
+	// calls OnSafeMode, rather than retrying a statement which can't
+	// succeed. Connectivity errors are always retried. Defaults to 5, zero
+	// retries data errors forever.
+	SafeModeAfter int
+	OnSafeMode    func(error)
+
+	safeModeLock sync.Mutex
+	safeModeErr  error
+}
+
+// SafeModeErr returns the error which put the subscriber in safe mode, for
+// health checks, or nil.
+func (s *Subscriber) SafeModeErr() error {
+	s.safeModeLock.Lock()
+	defer s.safeModeLock.Unlock()
+	return s.safeModeErr
+}
+
+func (s *Subscriber) enterSafeMode(err error) {
+	s.safeModeLock.Lock()
+	s.safeModeErr = err
+	s.safeModeLock.Unlock()
+	if s.OnSafeMode != nil {
+		s.OnSafeMode(err)
+	}
+}
+
+// IsDataError reports whether err is one which a retry won't fix: a stored
+// message whose headers can't be decoded, or a Postgres error for a data
+// exception, integrity violation, or syntax or access error such as a
+// missing column.
+func IsDataError(err error) bool {
+	if errors.Is(err, ErrMalformedHeaders) {
+		return true
+	}
+	state := sqlState(err)
+	if len(state) != 5 {
+		return false
+	}
+	switch state[:2] {
+	case "22", "23", "42":
+		return true
+	}
+	return false
+}
+
+func NewSubscriber(db sqrlx.Transactor, sender *NamedSender) *Subscriber {
+	return &Subscriber{
+		db:            db,
+		sender:        sender,
+		PollInterval:  time.Second,
+		BatchSize:     100,
+		SafeModeAfter: 5,
+	}
+}
+
+// Subscribe delivers the messages for destination until ctx is done, or the
+// subscriber enters safe mode, then closes the channel.
+func (s *Subscriber) Subscribe(ctx context.Context, destination string) <-chan *Delivery {
+	deliveries := make(chan *Delivery)
+	go func() {
+		defer close(deliveries)
+		dataErrors := 0
+		for {
+			delivered, err := s.deliverBatch(ctx, destination, deliveries)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil && s.OnError != nil {
+				s.OnError(err)
+			}
+			if err != nil && IsDataError(err) {
+				dataErrors++
+			} else {
+				dataErrors = 0
+			}
+			if s.SafeModeAfter > 0 && dataErrors >= s.SafeModeAfter {
+				s.enterSafeMode(err)
+				return
+			}
+			if err == nil && delivered > 0 {
+				continue
+			}
+
+			timer := time.NewTimer(s.PollInterval)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-s.Wake:
+				timer.Stop()
+			case <-timer.C:
+			}
+		}
+	}()
+	return deliveries
+}
+
+func (s *Subscriber) deliverBatch(ctx context.Context, destination string, deliveries chan<- *Delivery) (int, error) {
+	delivered := 0
+	err := s.db.Transact(ctx, &sqrlx.TxOptions{
+		ReadOnly:  false,
+		Isolation: sql.LevelReadCommitted,
+	}, func(ctx context.Context, tx sqrlx.Transaction) error {
+		delivered = 0
+		batch := []*Delivery{}
+		if err := s.sender.claimEach(ctx, tx, s.BatchSize, claimFilter{destination: destination}, func(delivery *Delivery) error {
+			batch = append(batch, delivery)
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		ids := make([]string, 0, len(batch))
+		for _, delivery := range batch {
+			select {
+			case deliveries <- delivery:
+				ids = append(ids, delivery.ID)
+			case <-ctx.Done():
+				// the transaction is rolled back with ctx, releasing the
+				// messages which were received, so they will be redelivered
+				return ctx.Err()
+			}
+		}
+		delivered = len(ids)
+		return s.sender.AckBatch(ctx, tx, ids...)
+	})
+	return delivered, err
+}
+
+// Subscribe consumes messages for destination from the DefaultSender's
+// table, see Subscriber.
+func Subscribe(ctx context.Context, conn sqrlx.Connection, destination string) (<-chan *Delivery, error) {
+	sender, err := defaultNamedSender()
+	if err != nil {
+		return nil, err
+	}
+	db, err := sqrlx.New(conn, sq.Dollar)
+	if err != nil {
+		return nil, err
+	}
+	return NewSubscriber(db, sender).Subscribe(ctx, destination), nil
+}
@@ -0,0 +1,126 @@
+package outbox
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	sq "github.com/elgris/sqrl"
+	"github.com/lib/pq"
+	"github.com/pentops/outbox.pg.go/internal/fakedb"
+	"github.com/pentops/sqrlx.go/sqrlx"
+)
+
+func TestIsDataError(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"malformed headers", fmt.Errorf("message a: %w", ErrMalformedHeaders), true},
+		{"invalid text", &pq.Error{Code: "22P02"}, true},
+		{"unique violation", &pq.Error{Code: "23505"}, true},
+		{"undefined column", &pq.Error{Code: "42703"}, true},
+		{"serialization failure", &pq.Error{Code: "40001"}, false},
+		{"connection failure", &pq.Error{Code: "08006"}, false},
+		{"other", errors.New("connection reset"), false},
+		{"nil", nil, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := IsDataError(tc.err); got != tc.want {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSubscriberSafeModeOnMalformedHeaders(t *testing.T) {
+	conn := fakedb.Open(func(query string, args []driver.NamedValue) (*fakedb.Result, error) {
+		if strings.HasPrefix(query, "SELECT") {
+			return &fakedb.Result{
+				Columns: []string{"id", "destination", "headers", "message"},
+				Rows:    [][]driver.Value{{"msg-1", "test.v1.Topic", "bad=%zz", []byte("body")}},
+			}, nil
+		}
+		return &fakedb.Result{}, nil
+	})
+	db, err := sqrlx.New(conn.DB, sq.Dollar)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subscriber := NewSubscriber(db, NewNamedSender(DefaultConfig()))
+	subscriber.PollInterval = time.Millisecond
+	subscriber.SafeModeAfter = 3
+	safeMode := make(chan error, 1)
+	subscriber.OnSafeMode = func(err error) {
+		safeMode <- err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for delivery := range subscriber.Subscribe(ctx, "test.v1.Topic") {
+		t.Fatalf("delivered %s with malformed headers", delivery.ID)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("the subscriber kept retrying the malformed message")
+	}
+
+	select {
+	case err := <-safeMode:
+		if !errors.Is(err, ErrMalformedHeaders) {
+			t.Errorf("safe mode for %v, want ErrMalformedHeaders", err)
+		}
+	default:
+		t.Fatal("OnSafeMode was not called")
+	}
+	if !errors.Is(subscriber.SafeModeErr(), ErrMalformedHeaders) {
+		t.Errorf("SafeModeErr is %v", subscriber.SafeModeErr())
+	}
+}
+
+func TestSubscriberMalformedRowMidBatch(t *testing.T) {
+	conn := fakedb.Open(func(query string, args []driver.NamedValue) (*fakedb.Result, error) {
+		if strings.HasPrefix(query, "SELECT") {
+			return &fakedb.Result{
+				Columns: []string{"id", "destination", "headers", "message"},
+				Rows: [][]driver.Value{
+					{"msg-1", "test.v1.Topic", "", []byte("body")},
+					{"msg-2", "test.v1.Topic", "bad=%zz", []byte("body")},
+					{"msg-3", "test.v1.Topic", "", []byte("body")},
+				},
+			}, nil
+		}
+		return &fakedb.Result{}, nil
+	})
+	db, err := sqrlx.New(conn.DB, sq.Dollar)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the default SafeModeAfter stops the subscription
+	subscriber := NewSubscriber(db, NewNamedSender(DefaultConfig()))
+	subscriber.PollInterval = time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for delivery := range subscriber.Subscribe(ctx, "test.v1.Topic") {
+		t.Errorf("delivered %s from a batch which failed to read", delivery.ID)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("the subscriber kept retrying the malformed message")
+	}
+	if !errors.Is(subscriber.SafeModeErr(), ErrMalformedHeaders) {
+		t.Errorf("SafeModeErr is %v", subscriber.SafeModeErr())
+	}
+	if reads := countStatements(conn.Statements(), "SELECT"); reads != subscriber.SafeModeAfter {
+		t.Errorf("read the batch %d times, want %d", reads, subscriber.SafeModeAfter)
+	}
+	if acks := countStatements(conn.Statements(), "DELETE"); acks != 0 {
+		t.Errorf("acked %d times", acks)
+	}
+}
@@ -0,0 +1,65 @@
+package outbox
+
+import (
+	"context"
+	"net/url"
+	"slices"
+)
+
+// TagHeader holds the message's tags, one value per tag.
+const TagHeader = "tag"
+
+// WithTag adds tags to this send, e.g. the feature flag which raised the
+// event, for relay routing with TagRoute and test assertions with WhereTag.
+func WithTag(tags ...string) SendOption {
+	return func(raw *Raw) {
+		headers := make(url.Values, len(raw.Headers)+1)
+		for k, v := range raw.Headers {
+			headers[k] = v
+		}
+		stored := slices.Clone(headers[TagHeader])
+		for _, tag := range tags {
+			if !slices.Contains(stored, tag) {
+				stored = append(stored, tag)
+			}
+		}
+		headers[TagHeader] = stored
+		raw.Headers = headers
+	}
+}
+
+// Tags returns the message's tags in the order they were added.
+func (delivery *Delivery) Tags() []string {
+	return delivery.Headers[TagHeader]
+}
+
+func (delivery *Delivery) HasTag(tag string) bool {
+	return slices.Contains(delivery.Headers[TagHeader], tag)
+}
+
+// TagRoute publishes each message with the route of its first tag which has
+// one, e.g. to send a flagged stream to a separate broker.
+type TagRoute struct {
+	Routes map[string]PublishFunc
+
+	// Optional, receives messages without a routed tag. When nil they fail
+	// with ErrDeliveryHeld.
+	Default PublishFunc
+}
+
+func (tr *TagRoute) Publish(ctx context.Context, delivery *Delivery) error {
+	for _, tag := range delivery.Tags() {
+		if publish, ok := tr.Routes[tag]; ok {
+			return publish(ctx, delivery)
+		}
+	}
+	if tr.Default == nil {
+		return &DeliveryError{
+			MessageID:   delivery.ID,
+			Destination: delivery.Destination,
+			Retryable:   true,
+			Err:         ErrDeliveryHeld,
+		}
+	}
+	return tr.Default(ctx, delivery)
+}
@@ -0,0 +1,40 @@
+package outbox
+
+import (
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// GRPCServiceHeader holds the full method name, e.g. /foo.v1.Topic/Bar,
+// which consumers route on.
+const GRPCServiceHeader = "grpc-service"
+
+// MethodTopic derives the topic and headers of messages from the gRPC
+// method which consumes them, rather than hand-maintained strings, e.g.
+//
+//	var barTopic = outbox.NewMethodTopic(foo_pb.File_foo_v1_topic_proto.
+//		Services().ByName("Topic").Methods().ByName("Bar"))
+//
+//	func (msg *BarMessage) MessagingTopic() string { return barTopic.MessagingTopic() }
+//	func (msg *BarMessage) MessagingHeaders() map[string]string { return barTopic.MessagingHeaders() }
+type MethodTopic struct {
+	method protoreflect.MethodDescriptor
+}
+
+func NewMethodTopic(method protoreflect.MethodDescriptor) MethodTopic {
+	return MethodTopic{
+		method: method,
+	}
+}
+
+// MessagingTopic is the full name of the service, e.g. foo.v1.Topic.
+func (mt MethodTopic) MessagingTopic() string {
+	return string(mt.method.Parent().FullName())
+}
+
+// MessagingHeaders returns a new map on each call, which the caller may add
+// to.
+func (mt MethodTopic) MessagingHeaders() map[string]string {
+	return map[string]string{
+		GRPCServiceHeader: "/" + mt.MessagingTopic() + "/" + string(mt.method.Name()),
+	}
+}
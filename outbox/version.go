@@ -0,0 +1,100 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// MessageVersionHeader holds the schema version of the message payload.
+const MessageVersionHeader = "message-version"
+
+// VersionedMessage is implemented by messages which set their own version.
+type VersionedMessage interface {
+	OutboxMessage
+	MessagingVersion() string
+}
+
+var packageVersion = regexp.MustCompile(`(?:^|\.)(v[0-9]+(?:(?:alpha|beta)[0-9]*)?)$`)
+
+// ProtoPackageVersion gives the version suffix of the message's proto
+// package, e.g. v1 for foo.v1.Bar, for NamedSender.MessageVersion.
+func ProtoPackageVersion(msg OutboxMessage) string {
+	pkg := string(msg.ProtoReflect().Descriptor().ParentFile().Package())
+	match := packageVersion.FindStringSubmatch(pkg)
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
+
+// VersionRouter passes deliveries to a handler by their message-version
+// header, so consumers can decode each payload version into the right type
+// while producers move between schema versions.
+type VersionRouter struct {
+	handlers map[string]func(context.Context, *Delivery) error
+
+	// Optional, handles versions without a handler, including deliveries
+	// without the header, which have the empty version.
+	Default func(context.Context, *Delivery) error
+
+	// Set when the sender has AnyPayload, so that UnmarshalVersion unwraps
+	// the anypb.Any, refusing one which holds another message type.
+	AnyPayload bool
+}
+
+func NewVersionRouter() *VersionRouter {
+	return &VersionRouter{
+		handlers: map[string]func(context.Context, *Delivery) error{},
+	}
+}
+
+func (vr *VersionRouter) Handle(version string, handler func(context.Context, *Delivery) error) {
+	vr.handlers[version] = handler
+}
+
+// UnmarshalVersion registers a handler which decodes the payload into a new
+// message of the registered version's type.
+func UnmarshalVersion[M proto.Message](vr *VersionRouter, version string, handler func(context.Context, M) error) {
+	vr.Handle(version, func(ctx context.Context, delivery *Delivery) error {
+		var msg M
+		msg = msg.ProtoReflect().Type().New().Interface().(M)
+		if err := vr.unmarshal(delivery.Data, msg); err != nil {
+			return &DeliveryError{
+				MessageID:   delivery.ID,
+				Destination: delivery.Destination,
+				Err:         fmt.Errorf("decoding version %q: %w", version, err),
+			}
+		}
+		return handler(ctx, msg)
+	})
+}
+
+func (vr *VersionRouter) unmarshal(data []byte, msg proto.Message) error {
+	if !vr.AnyPayload {
+		return proto.Unmarshal(data, msg)
+	}
+	wrapped := &anypb.Any{}
+	if err := proto.Unmarshal(data, wrapped); err != nil {
+		return err
+	}
+	return wrapped.UnmarshalTo(msg)
+}
+
+func (vr *VersionRouter) Route(ctx context.Context, delivery *Delivery) error {
+	version := delivery.Headers.Get(MessageVersionHeader)
+	if handler, ok := vr.handlers[version]; ok {
+		return handler(ctx, delivery)
+	}
+	if vr.Default != nil {
+		return vr.Default(ctx, delivery)
+	}
+	return &DeliveryError{
+		MessageID:   delivery.ID,
+		Destination: delivery.Destination,
+		Err:         fmt.Errorf("no handler for version %q", version),
+	}
+}
@@ -0,0 +1,68 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestUnmarshalVersionPayloads(t *testing.T) {
+	marshal := func(msg proto.Message, wrapAny bool) []byte {
+		if wrapAny {
+			wrapped, err := anypb.New(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg = wrapped
+		}
+		data, err := proto.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	for _, tc := range []struct {
+		name       string
+		anyPayload bool
+		data       []byte
+		wantErr    bool
+	}{
+		{name: "plain", data: marshal(wrapperspb.String("hello"), false)},
+		{name: "any", anyPayload: true, data: marshal(wrapperspb.String("hello"), true)},
+		{name: "any of another type", anyPayload: true, data: marshal(wrapperspb.Int64(7), true), wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			router := NewVersionRouter()
+			router.AnyPayload = tc.anyPayload
+			var got string
+			UnmarshalVersion(router, "v1", func(ctx context.Context, msg *wrapperspb.StringValue) error {
+				got = msg.Value
+				return nil
+			})
+
+			err := router.Route(context.Background(), &Delivery{
+				ID:      "msg-1",
+				Headers: map[string][]string{MessageVersionHeader: {"v1"}},
+				Data:    tc.data,
+			})
+			if tc.wantErr {
+				deliveryErr := &DeliveryError{}
+				if !errors.As(err, &deliveryErr) || deliveryErr.Retryable {
+					t.Fatalf("got %v, want a DeliveryError which isn't retryable", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != "hello" {
+				t.Errorf("decoded %q", got)
+			}
+		})
+	}
+}
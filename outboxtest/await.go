@@ -0,0 +1,67 @@
+package outboxtest
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	sq "github.com/elgris/sqrl"
+	"github.com/pentops/outbox.pg.go/outbox"
+	"github.com/pentops/sqrlx.go/sqrlx"
+)
+
+func (oa *OutboxAsserter) AwaitDelivered(tb TB, matcher Matcher, timeout time.Duration) {
+	tb.Helper()
+	oa.AwaitDeliveredCtx(context.Background(), tb, matcher, timeout)
+}
+
+// AwaitDeliveredCtx waits for a message the matcher accepts to be acked by
+// a relay running in the test, then pops it from the ArchiveTable, or from
+// the messages marked as delivered with a DeliveredAtColumn. Pending
+// messages are left for the relay, so a message can't be consumed before
+// the assertion sees it.
+func (oa *OutboxAsserter) AwaitDeliveredCtx(ctx context.Context, tb TB, matcher Matcher, timeout time.Duration) {
+	tb.Helper()
+	if oa.ArchiveTable == "" {
+		tb.Fatal("AwaitDelivered needs the asserter's ArchiveTable")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		var msgID string
+		err := oa.db.Transact(ctx, oa.TxOptions, func(ctx context.Context, tx sqrlx.Transaction) error {
+			var err error
+			table := oa.ArchiveTable
+			msgID, err = oa.findMatch(ctx, tx, oa.messages(table), matcher)
+			if err == nil && msgID == "" && oa.DeliveredAtColumn != "" {
+				// acked but not yet moved by ArchiveDelivered
+				table = oa.TableName
+				msgID, err = oa.findMatch(ctx, tx, oa.messages(table).
+					Where(sq.NotEq{oa.DeliveredAtColumn: nil}), matcher)
+			}
+			if err != nil || msgID == "" {
+				return err
+			}
+			_, err = tx.Delete(ctx, sq.Delete(table).
+				Where(sq.Eq{oa.IDColumn: msgID}))
+			return err
+		})
+		if err == nil && msgID != "" {
+			return
+		}
+		if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+			tb.Fatal(contextError(ctx, err))
+		}
+
+		timer := time.NewTimer(oa.PollInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			tb.Fatalf("assertion failed, %s delivered on %s with custom matcher after %s", outbox.ErrNoMessages, matcher.MessagingTopic(), timeout)
+			return
+		case <-timer.C:
+		}
+	}
+}
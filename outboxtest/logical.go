@@ -0,0 +1,161 @@
+package outboxtest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/pentops/outbox.pg.go/outbox"
+	"github.com/pentops/sqrlx.go/sqrlx"
+)
+
+// LogicalMessageReader asserts on messages sent with
+// outbox.LogicalMessageSender, reading them from a test_decoding replication
+// slot. Changes are consumed from the slot as they are read, and held by the
+// reader until popped.
+type LogicalMessageReader struct {
+	conn    sqrlx.Connection
+	pending []outbox.LogicalMessage
+
+	SlotName          string
+	Prefix            string
+	ServiceNameHeader string
+
+	// Set when the sender stores payloads wrapped in an anypb.Any
+	AnyPayload bool
+}
+
+// NewLogicalMessageReader creates the replication slot, which only receives
+// messages sent after it exists. Call Close to drop the slot.
+func NewLogicalMessageReader(t TB, conn sqrlx.Connection, slotName string, prefix string) *LogicalMessageReader {
+	t.Helper()
+	if _, err := conn.ExecContext(context.Background(), "SELECT pg_create_logical_replication_slot($1, 'test_decoding')", slotName); err != nil {
+		t.Fatal(err.Error())
+	}
+	return &LogicalMessageReader{
+		conn: conn,
+
+		SlotName:          slotName,
+		Prefix:            prefix,
+		ServiceNameHeader: outbox.GRPCServiceHeader,
+	}
+}
+
+func (lr *LogicalMessageReader) Close(tb TB) {
+	tb.Helper()
+	if _, err := lr.conn.ExecContext(context.Background(), "SELECT pg_drop_replication_slot($1)", lr.SlotName); err != nil {
+		tb.Fatal(err.Error())
+	}
+}
+
+func (lr *LogicalMessageReader) fetch(ctx context.Context) error {
+	rows, err := lr.conn.QueryContext(ctx, "SELECT data FROM pg_logical_slot_get_changes($1, NULL, NULL)", lr.SlotName)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return err
+		}
+		content, ok := parseTestDecoding(data, lr.Prefix)
+		if !ok {
+			continue
+		}
+		msg := outbox.LogicalMessage{}
+		if err := json.Unmarshal([]byte(content), &msg); err != nil {
+			return fmt.Errorf("decoding logical message %q: %w", content, err)
+		}
+		lr.pending = append(lr.pending, msg)
+	}
+	return rows.Err()
+}
+
+// parseTestDecoding returns the content of test_decoding output for a
+// message with prefix, e.g.
+// `message: transactional: 1 prefix: outbox, sz: 12 content:...`
+func parseTestDecoding(data string, prefix string) (string, bool) {
+	if !strings.HasPrefix(data, "message: ") {
+		return "", false
+	}
+	marker := " prefix: " + prefix + ", sz: "
+	idx := strings.Index(data, marker)
+	if idx < 0 {
+		return "", false
+	}
+	rest := data[idx+len(marker):]
+	idx = strings.Index(rest, " content:")
+	if idx < 0 {
+		return "", false
+	}
+	return rest[idx+len(" content:"):], true
+}
+
+func (lr *LogicalMessageReader) PopMessage(tb TB, message OutboxMessage) {
+	tb.Helper()
+	lr.PopMessageCtx(context.Background(), tb, message)
+}
+
+func (lr *LogicalMessageReader) PopMessageCtx(ctx context.Context, tb TB, message OutboxMessage) {
+	tb.Helper()
+
+	if err := lr.fetch(ctx); err != nil {
+		tb.Fatal(contextError(ctx, err))
+	}
+
+	destination := message.MessagingTopic()
+	for idx, msg := range lr.pending {
+		if msg.Destination != destination {
+			continue
+		}
+
+		storedHeaders, err := outbox.DecodeHeaders(msg.Headers)
+		if err != nil {
+			tb.Fatal((&HeaderDecodeError{
+				MessageID:   msg.ID,
+				Destination: msg.Destination,
+				Headers:     msg.Headers,
+				Data:        msg.Message,
+				Err:         err,
+			}).Error())
+		}
+		storedServiceHeader := storedHeaders.Get(lr.ServiceNameHeader)
+
+		if provided := message.MessagingHeaders()[lr.ServiceNameHeader]; provided != storedServiceHeader {
+			tb.Fatalf("service name header (%s) should be %s but was %s", lr.ServiceNameHeader, provided, storedServiceHeader)
+		}
+
+		if err := unmarshalPayload(msg.Message, lr.AnyPayload, message); err != nil {
+			tb.Fatal(err.Error())
+		}
+
+		lr.pending = append(lr.pending[:idx], lr.pending[idx+1:]...)
+		return
+	}
+
+	tb.Fatalf("assertion failed, %s on %s for %T", outbox.ErrNoMessages, destination, message)
+}
+
+func (lr *LogicalMessageReader) AssertNoMessages(tb TB) {
+	tb.Helper()
+	lr.AssertNoMessagesCtx(context.Background(), tb)
+}
+
+func (lr *LogicalMessageReader) AssertNoMessagesCtx(ctx context.Context, tb TB) {
+	tb.Helper()
+
+	if err := lr.fetch(ctx); err != nil {
+		tb.Fatal(contextError(ctx, err))
+	}
+
+	if len(lr.pending) != 0 {
+		destinations := make([]string, 0, len(lr.pending))
+		for _, msg := range lr.pending {
+			destinations = append(destinations, msg.Destination)
+		}
+		tb.Fatalf("No messages expected, but found %d: %s", len(lr.pending), strings.Join(destinations, ", "))
+	}
+}
@@ -0,0 +1,64 @@
+package outboxtest
+
+import "testing"
+
+func TestParseTestDecoding(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		data   string
+		prefix string
+		want   string
+		ok     bool
+	}{{
+		name:   "message",
+		data:   `message: transactional: 1 prefix: outbox, sz: 12 content:{"id":"a"}`,
+		prefix: "outbox",
+		want:   `{"id":"a"}`,
+		ok:     true,
+	}, {
+		name:   "non-transactional",
+		data:   `message: transactional: 0 prefix: outbox, sz: 2 content:{}`,
+		prefix: "outbox",
+		want:   `{}`,
+		ok:     true,
+	}, {
+		name:   "empty content",
+		data:   `message: transactional: 1 prefix: outbox, sz: 0 content:`,
+		prefix: "outbox",
+		want:   "",
+		ok:     true,
+	}, {
+		name:   "content containing the markers",
+		data:   `message: transactional: 1 prefix: outbox, sz: 40 content:{"m":" prefix: outbox, sz: 1 content:x"}`,
+		prefix: "outbox",
+		want:   `{"m":" prefix: outbox, sz: 1 content:x"}`,
+		ok:     true,
+	}, {
+		name:   "other prefix",
+		data:   `message: transactional: 1 prefix: audit, sz: 2 content:{}`,
+		prefix: "outbox",
+	}, {
+		name:   "longer prefix",
+		data:   `message: transactional: 1 prefix: outbox2, sz: 2 content:{}`,
+		prefix: "outbox",
+	}, {
+		name:   "table change",
+		data:   `table public.outbox: INSERT: id[text]:'a'`,
+		prefix: "outbox",
+	}, {
+		name:   "transaction boundary",
+		data:   `BEGIN 1234`,
+		prefix: "outbox",
+	}, {
+		name:   "truncated",
+		data:   `message: transactional: 1 prefix: outbox, sz: 12`,
+		prefix: "outbox",
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := parseTestDecoding(tc.data, tc.prefix)
+			if ok != tc.ok || got != tc.want {
+				t.Errorf("got %q, %v, want %q, %v", got, ok, tc.want, tc.ok)
+			}
+		})
+	}
+}
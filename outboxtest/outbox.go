@@ -6,15 +6,19 @@ import (
 	"errors"
 	"fmt"
 	"net/url"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	sq "github.com/elgris/sqrl"
+	"github.com/pentops/outbox.pg.go/outbox"
 	"github.com/pentops/sqrlx.go/sqrlx"
 	"google.golang.org/protobuf/proto"
 )
 
-type tb interface {
+type TB interface {
 	Fatal(args ...any)
 	Fatalf(format string, args ...any)
 	Helper()
@@ -23,32 +27,126 @@ type tb interface {
 type OutboxAsserter struct {
 	db *sqrlx.Wrapper
 
-	TableName         string
-	IDColumn          string
-	HeadersColumn     string
-	DataColumn        string
-	DestinationColumn string
+	// The table layout. CreatedAtColumn and AggregateSequenceColumn order
+	// ForEachMessageMeta when set, ArchiveTable is read by AwaitDelivered,
+	// and messages marked in DeliveredAtColumn are no longer pending.
+	outbox.Config
+
 	ServiceNameHeader string
+
+	// Time between reads while awaiting a message
+	PollInterval time.Duration
+
+	// Options for every assertion's transaction
+	TxOptions *sqrlx.TxOptions
+
+	// Optional, skips messages whose headers can't be decoded, collecting
+	// them for MalformedHeaders, rather than failing the assertion.
+	SkipMalformedHeaders bool
+
+	malformedLock sync.Mutex
+	malformed     []*HeaderDecodeError
+}
+
+// HeaderDecodeError is a stored message whose headers couldn't be decoded,
+// with the raw row for debugging. It wraps outbox.ErrMalformedHeaders.
+type HeaderDecodeError struct {
+	MessageID   string
+	Destination string
+	Headers     string
+	Data        []byte
+	Err         error
+}
+
+func (err *HeaderDecodeError) Error() string {
+	return fmt.Sprintf("message %s on %s: %s, headers %q, data %x", err.MessageID, err.Destination, err.Err, err.Headers, err.Data)
+}
+
+func (err *HeaderDecodeError) Unwrap() error {
+	return err.Err
+}
+
+// MalformedHeaders returns the messages skipped under SkipMalformedHeaders,
+// so that a test can report them, or assert there were none.
+func (oa *OutboxAsserter) MalformedHeaders() []*HeaderDecodeError {
+	oa.malformedLock.Lock()
+	defer oa.malformedLock.Unlock()
+	return slices.Clone(oa.malformed)
+}
+
+// decodeHeaders decodes a row's stored headers, returning false for a row
+// skipped under SkipMalformedHeaders.
+func (oa *OutboxAsserter) decodeHeaders(msgID string, destination string, stored string, data []byte) (url.Values, bool, error) {
+	headers, err := outbox.DecodeHeaders(stored)
+	if err == nil {
+		return headers, true, nil
+	}
+	decodeErr := &HeaderDecodeError{
+		MessageID:   msgID,
+		Destination: destination,
+		Headers:     stored,
+		Data:        data,
+		Err:         err,
+	}
+	if !oa.SkipMalformedHeaders {
+		return nil, false, decodeErr
+	}
+
+	oa.malformedLock.Lock()
+	defer oa.malformedLock.Unlock()
+	// transactions are retried, so the same row can be skipped again
+	for _, existing := range oa.malformed {
+		if existing.MessageID == msgID {
+			return nil, false, nil
+		}
+	}
+	oa.malformed = append(oa.malformed, decodeErr)
+	return nil, false, nil
+}
+
+func NewOutboxAsserter(t TB, conn sqrlx.Connection) *OutboxAsserter {
+	return NewOutboxAsserterFromConfig(t, conn, outbox.DefaultConfig())
+}
+
+// NewOutboxAsserterFromSender reads the table layout and payload format of
+// sender, so that tests use the same options as production. Headers are
+// decoded in whichever HeaderEncoding the sender uses.
+func NewOutboxAsserterFromSender(t TB, conn sqrlx.Connection, sender *outbox.NamedSender) *OutboxAsserter {
+	return NewOutboxAsserterFromConfig(t, conn, sender.Config)
 }
 
-func NewOutboxAsserter(t tb, conn sqrlx.Connection) *OutboxAsserter {
+func NewOutboxAsserterFromConfig(t TB, conn sqrlx.Connection, config outbox.Config) *OutboxAsserter {
 	db, err := sqrlx.New(conn, sq.Dollar)
 	if err != nil {
 		t.Fatal(err.Error())
 	}
+	// serialization failures and deadlocks between concurrent tests retry
+	// the assertion rather than failing the test
+	db.ShouldRetryTransaction = outbox.IsRetryable
 	return &OutboxAsserter{
-		db: db,
+		db:     db,
+		Config: config,
 
-		TableName:         "outbox",
-		IDColumn:          "id",
-		HeadersColumn:     "headers",
-		DataColumn:        "message",
-		DestinationColumn: "destination",
+		ServiceNameHeader: outbox.GRPCServiceHeader,
+		PollInterval:      50 * time.Millisecond,
 
-		ServiceNameHeader: "grpc-service",
+		TxOptions: &sqrlx.TxOptions{
+			ReadOnly:  false,
+			Isolation: sql.LevelSerializable,
+		},
 	}
 }
 
+// contextError describes a failed operation, pointing at the context when
+// it was cancelled or hit its deadline, which otherwise shows up as an
+// unhelpful driver error.
+func contextError(ctx context.Context, err error) string {
+	if ctxErr := ctx.Err(); ctxErr != nil && !errors.Is(err, ctxErr) {
+		return fmt.Sprintf("%s (context: %s)", err, ctxErr)
+	}
+	return err.Error()
+}
+
 type OutboxMessage interface {
 	MessagingTopic() string
 	MessagingHeaders() map[string]string
@@ -57,35 +155,59 @@ type OutboxMessage interface {
 
 func (oa *OutboxAsserter) PopMessage(tb TB, message OutboxMessage) {
 	tb.Helper()
+	oa.PopMessageCtx(context.Background(), tb, message)
+}
+
+func (oa *OutboxAsserter) PopMessageCtx(ctx context.Context, tb TB, message OutboxMessage) {
+	tb.Helper()
 
 	destination := message.MessagingTopic()
 
-	if err := oa.db.Transact(context.Background(), nil, func(ctx context.Context, tx sqrlx.Transaction) error {
+	if err := oa.db.Transact(ctx, oa.TxOptions, func(ctx context.Context, tx sqrlx.Transaction) error {
 		tb.Helper()
 		var msgID string
 		var msgHeader string
 		var msgContent []byte
+		var storedHeaders url.Values
 
-		if err := tx.SelectRow(
+		rows, err := tx.Select(
 			ctx,
-			sq.Select(oa.IDColumn, oa.HeadersColumn, oa.DataColumn).
-				From(oa.TableName).
-				Where(sq.Eq{oa.DestinationColumn: destination}).
-				Limit(1),
-		).Scan(&msgID, &msgHeader, &msgContent); errors.Is(err, sql.ErrNoRows) {
-			return fmt.Errorf("assertion failed, no outbox messages on %s for %T", destination, message)
-		} else if err != nil {
+			oa.pending(oa.messages(oa.TableName)).
+				Where(sq.Eq{oa.DestinationColumn: destination}),
+		)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			if err := rows.Scan(&msgID, &msgHeader, &msgContent); err != nil {
+				return err
+			}
+			headers, ok, err := oa.decodeHeaders(msgID, destination, msgHeader, msgContent)
+			if err != nil {
+				return err
+			}
+			if ok {
+				storedHeaders = headers
+				break
+			}
+		}
+		if err := rows.Err(); err != nil {
 			return err
 		}
+		rows.Close()
 
-		storedHeaders, _ := url.ParseQuery(msgHeader)
+		if storedHeaders == nil {
+			return fmt.Errorf("assertion failed, %w on %s for %T", outbox.ErrNoMessages, destination, message)
+		}
 		storedServiceHeader := storedHeaders.Get(oa.ServiceNameHeader)
 
 		if provided := message.MessagingHeaders()[oa.ServiceNameHeader]; provided != storedServiceHeader {
 			return fmt.Errorf("service name header (%s) should be %s but was %s", oa.ServiceNameHeader, provided, storedServiceHeader)
 		}
 
-		if err := proto.Unmarshal(msgContent, message); err != nil {
+		if err := unmarshalPayload(msgContent, oa.AnyPayload, message); err != nil {
 			return err
 		}
 
@@ -97,13 +219,14 @@ func (oa *OutboxAsserter) PopMessage(tb TB, message OutboxMessage) {
 		return nil
 
 	}); err != nil {
-		tb.Fatalf(err.Error())
+		tb.Fatal(contextError(ctx, err))
 	}
 }
 
 type MessageMatch[M OutboxMessage] struct {
-	Message    M
-	conditions []func(M) bool
+	Message          M
+	conditions       []func(M) bool
+	headerConditions []func(url.Values) bool
 }
 
 func NewMatcher[M OutboxMessage](message M, where ...func(M) bool) MessageMatch[M] {
@@ -113,12 +236,40 @@ func NewMatcher[M OutboxMessage](message M, where ...func(M) bool) MessageMatch[
 	}
 }
 
+// WhereHeader adds a condition that the stored message has each of the
+// values for the header, or just has the header when no values are given.
+func (m MessageMatch[M]) WhereHeader(key string, values ...string) MessageMatch[M] {
+	m.headerConditions = append(append([]func(url.Values) bool{}, m.headerConditions...), func(headers url.Values) bool {
+		stored, ok := headers[key]
+		if !ok {
+			return false
+		}
+		for _, want := range values {
+			if !slices.Contains(stored, want) {
+				return false
+			}
+		}
+		return true
+	})
+	return m
+}
+
+// WhereTag adds a condition that the stored message was sent with each of
+// the tags, see outbox.WithTag.
+func (m MessageMatch[M]) WhereTag(tags ...string) MessageMatch[M] {
+	return m.WhereHeader(outbox.TagHeader, tags...)
+}
+
 func (m MessageMatch[M]) MessagingTopic() string {
 	return m.Message.MessagingTopic()
 }
 
 func (m MessageMatch[M]) Attempt(serviceName string, data []byte) (bool, error) {
-	if serviceName != m.Message.MessagingHeaders()["grpc-service"] {
+	return m.attempt(outbox.GRPCServiceHeader, serviceName, data)
+}
+
+func (m MessageMatch[M]) attempt(serviceHeader string, serviceName string, data []byte) (bool, error) {
+	if serviceName != m.Message.MessagingHeaders()[serviceHeader] {
 		return false, nil
 	}
 
@@ -140,12 +291,41 @@ type Matcher interface {
 	Attempt(serviceName string, data []byte) (bool, error)
 }
 
+// HeaderMatcher is implemented by matchers which check all of the stored
+// headers, including repeated values, and is used in place of Attempt.
+// serviceHeader is the asserter's ServiceNameHeader.
+type HeaderMatcher interface {
+	Matcher
+	AttemptHeaders(serviceHeader string, headers url.Values, data []byte) (bool, error)
+}
+
+func (m MessageMatch[M]) AttemptHeaders(serviceHeader string, headers url.Values, data []byte) (bool, error) {
+	for _, condition := range m.headerConditions {
+		if !condition(headers) {
+			return false, nil
+		}
+	}
+	return m.attempt(serviceHeader, headers.Get(serviceHeader), data)
+}
+
+func (oa *OutboxAsserter) attempt(matcher Matcher, headers url.Values, data []byte) (bool, error) {
+	if headerMatcher, ok := matcher.(HeaderMatcher); ok {
+		return headerMatcher.AttemptHeaders(oa.ServiceNameHeader, headers, data)
+	}
+	return matcher.Attempt(headers.Get(oa.ServiceNameHeader), data)
+}
+
 func (oa *OutboxAsserter) PopMatching(tb TB, matcher Matcher) {
 	tb.Helper()
+	oa.PopMatchingCtx(context.Background(), tb, matcher)
+}
+
+func (oa *OutboxAsserter) PopMatchingCtx(ctx context.Context, tb TB, matcher Matcher) {
+	tb.Helper()
 
 	destination := matcher.MessagingTopic()
 
-	if err := oa.db.Transact(context.Background(), nil, func(ctx context.Context, tx sqrlx.Transaction) error {
+	if err := oa.db.Transact(ctx, oa.TxOptions, func(ctx context.Context, tx sqrlx.Transaction) error {
 		tb.Helper()
 		var msgID string
 		var msgHeader string
@@ -153,8 +333,7 @@ func (oa *OutboxAsserter) PopMatching(tb TB, matcher Matcher) {
 
 		rows, err := tx.Select(
 			ctx,
-			sq.Select(oa.IDColumn, oa.HeadersColumn, oa.DataColumn).
-				From(oa.TableName).
+			oa.pending(oa.messages(oa.TableName)).
 				Where(sq.Eq{oa.DestinationColumn: destination}),
 		)
 		if err != nil {
@@ -167,14 +346,23 @@ func (oa *OutboxAsserter) PopMatching(tb TB, matcher Matcher) {
 		for rows.Next() {
 			err := rows.Scan(&msgID, &msgHeader, &msgContent)
 			if errors.Is(err, sql.ErrNoRows) {
-				return fmt.Errorf("assertion failed, no outbox messages on %s", destination)
+				return fmt.Errorf("assertion failed, %w on %s", outbox.ErrNoMessages, destination)
 			} else if err != nil {
 				return err
 			}
 
-			storedHeaders, _ := url.ParseQuery(msgHeader)
-			storedServiceHeader := storedHeaders.Get(oa.ServiceNameHeader)
-			didHandle, err := matcher.Attempt(storedServiceHeader, msgContent)
+			storedHeaders, ok, err := oa.decodeHeaders(msgID, destination, msgHeader, msgContent)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			payload, err := unwrapPayload(msgContent, oa.AnyPayload)
+			if err != nil {
+				return err
+			}
+			didHandle, err := oa.attempt(matcher, storedHeaders, payload)
 			if err != nil {
 				return err
 			}
@@ -191,7 +379,7 @@ func (oa *OutboxAsserter) PopMatching(tb TB, matcher Matcher) {
 		}
 
 		if foundOne == "" {
-			return fmt.Errorf("no messages matched for %s with custom matcher", destination)
+			return fmt.Errorf("%w matched for %s with custom matcher", outbox.ErrNoMessages, destination)
 		}
 
 		if _, err := tx.Delete(ctx, sq.Delete(oa.TableName).
@@ -203,62 +391,339 @@ func (oa *OutboxAsserter) PopMatching(tb TB, matcher Matcher) {
 		return nil
 
 	}); err != nil {
-		tb.Fatalf(err.Error())
+		tb.Fatal(contextError(ctx, err))
+	}
+}
+
+// PopSet pops one message for each matcher, in any order, for handlers which
+// emit several messages without a defined order. Nothing is popped unless
+// every matcher matched a different message. When matchers overlap, each is
+// assigned a message so that as many as possible match, regardless of the
+// order they are given in.
+func (oa *OutboxAsserter) PopSet(tb TB, matchers ...Matcher) {
+	tb.Helper()
+	oa.PopSetCtx(context.Background(), tb, matchers...)
+}
+
+func (oa *OutboxAsserter) PopSetCtx(ctx context.Context, tb TB, matchers ...Matcher) {
+	tb.Helper()
+
+	if err := oa.db.Transact(ctx, oa.TxOptions, func(ctx context.Context, tx sqrlx.Transaction) error {
+		candidates := map[string][]*setCandidate{}
+		for _, matcher := range matchers {
+			topic := matcher.MessagingTopic()
+			if _, ok := candidates[topic]; ok {
+				continue
+			}
+			loaded, err := oa.setCandidates(ctx, tx, topic)
+			if err != nil {
+				return err
+			}
+			candidates[topic] = loaded
+		}
+
+		accepts := make([][]*setCandidate, len(matchers))
+		for idx, matcher := range matchers {
+			for _, candidate := range candidates[matcher.MessagingTopic()] {
+				didHandle, err := oa.attempt(matcher, candidate.headers, candidate.payload)
+				if err != nil {
+					return err
+				}
+				if didHandle {
+					accepts[idx] = append(accepts[idx], candidate)
+				}
+			}
+		}
+
+		assigned := assignSet(accepts)
+		matchedIDs := []string{}
+		unmatched := []string{}
+		for idx, matcher := range matchers {
+			candidate := assigned[idx]
+			if candidate == nil {
+				unmatched = append(unmatched, fmt.Sprintf("#%d %T on %s", idx, matcher, matcher.MessagingTopic()))
+				continue
+			}
+			// leave the matcher holding the message it was assigned, rather
+			// than the last one it was tried against
+			if _, err := oa.attempt(matcher, candidate.headers, candidate.payload); err != nil {
+				return err
+			}
+			matchedIDs = append(matchedIDs, candidate.id)
+		}
+
+		if len(unmatched) > 0 {
+			return fmt.Errorf("assertion failed, %w for %d of %d matchers: %s", outbox.ErrNoMessages, len(unmatched), len(matchers), strings.Join(unmatched, ", "))
+		}
+
+		if len(matchedIDs) == 0 {
+			return nil
+		}
+
+		_, err := tx.Delete(ctx, sq.Delete(oa.TableName).
+			Where(sq.Eq{oa.IDColumn: matchedIDs}))
+		return err
+
+	}); err != nil {
+		tb.Fatal(contextError(ctx, err))
 	}
 }
 
+type setCandidate struct {
+	id      string
+	headers url.Values
+	payload []byte
+}
+
+// setCandidates loads the pending messages for a topic.
+func (oa *OutboxAsserter) setCandidates(ctx context.Context, tx sqrlx.Transaction, topic string) ([]*setCandidate, error) {
+	rows, err := tx.Select(ctx, oa.pending(oa.messages(oa.TableName)).
+		Where(sq.Eq{oa.DestinationColumn: topic}))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	candidates := []*setCandidate{}
+	for rows.Next() {
+		var msgID string
+		var msgHeader string
+		var msgContent []byte
+		if err := rows.Scan(&msgID, &msgHeader, &msgContent); err != nil {
+			return nil, err
+		}
+		storedHeaders, ok, err := oa.decodeHeaders(msgID, topic, msgHeader, msgContent)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		payload, err := unwrapPayload(msgContent, oa.AnyPayload)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, &setCandidate{
+			id:      msgID,
+			headers: storedHeaders,
+			payload: payload,
+		})
+	}
+	return candidates, rows.Err()
+}
+
+// assignSet gives each matcher a different candidate from those it accepts,
+// matching as many matchers as possible, by augmenting paths. Matchers left
+// without a candidate are nil.
+func assignSet(accepts [][]*setCandidate) []*setCandidate {
+	assigned := make([]*setCandidate, len(accepts))
+	owner := map[*setCandidate]int{}
+
+	var augment func(idx int, visited map[*setCandidate]bool) bool
+	augment = func(idx int, visited map[*setCandidate]bool) bool {
+		for _, candidate := range accepts[idx] {
+			if visited[candidate] {
+				continue
+			}
+			visited[candidate] = true
+			current, taken := owner[candidate]
+			if !taken || augment(current, visited) {
+				owner[candidate] = idx
+				assigned[idx] = candidate
+				return true
+			}
+		}
+		return false
+	}
+
+	for idx := range accepts {
+		augment(idx, map[*setCandidate]bool{})
+	}
+	return assigned
+}
+
+// messages selects the ID, headers and data of the messages in table.
+func (oa *OutboxAsserter) messages(table string) *sq.SelectBuilder {
+	return sq.Select(oa.IDColumn, oa.HeadersColumn, oa.DataColumn).
+		From(table)
+}
+
+// pending restricts a query on the outbox table to messages which haven't
+// been acked, when the layout has a DeliveredAtColumn.
+func (oa *OutboxAsserter) pending(query *sq.SelectBuilder) *sq.SelectBuilder {
+	if oa.DeliveredAtColumn == "" {
+		return query
+	}
+	return query.Where(sq.Eq{oa.DeliveredAtColumn: nil})
+}
+
+// findMatch returns the ID of the first message from query the matcher
+// accepts, or an empty string.
+func (oa *OutboxAsserter) findMatch(ctx context.Context, tx sqrlx.Transaction, query *sq.SelectBuilder, matcher Matcher) (string, error) {
+	query = query.Where(sq.Eq{oa.DestinationColumn: matcher.MessagingTopic()})
+
+	rows, err := tx.Select(ctx, query)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var msgID string
+		var msgHeader string
+		var msgContent []byte
+		if err := rows.Scan(&msgID, &msgHeader, &msgContent); err != nil {
+			return "", err
+		}
+
+		storedHeaders, ok, err := oa.decodeHeaders(msgID, matcher.MessagingTopic(), msgHeader, msgContent)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			continue
+		}
+		payload, err := unwrapPayload(msgContent, oa.AnyPayload)
+		if err != nil {
+			return "", err
+		}
+		didHandle, err := oa.attempt(matcher, storedHeaders, payload)
+		if err != nil {
+			return "", err
+		}
+		if didHandle {
+			return msgID, nil
+		}
+	}
+	return "", rows.Err()
+}
+
 func (oa *OutboxAsserter) ForEachMessage(tb TB, callback func(string, string, []byte)) {
+	tb.Helper()
+	oa.ForEachMessageCtx(context.Background(), tb, callback)
+}
+
+func (oa *OutboxAsserter) ForEachMessageCtx(ctx context.Context, tb TB, callback func(string, string, []byte)) {
+	tb.Helper()
+	oa.ForEachMessageMetaCtx(ctx, tb, func(msg *MessageMeta) {
+		callback(msg.Destination, msg.Headers.Get(oa.ServiceNameHeader), msg.Data)
+	})
+}
+
+// MessageMeta is a stored message with its identity and ordering columns.
+type MessageMeta struct {
+	ID          string
+	Destination string
+	Headers     url.Values
+	Data        []byte
+
+	// Zero unless the asserter has a CreatedAtColumn or AggregateSequenceColumn
+	CreatedAt time.Time
+	Sequence  uint64
+}
+
+func (oa *OutboxAsserter) ForEachMessageMeta(tb TB, callback func(*MessageMeta)) {
+	tb.Helper()
+	oa.ForEachMessageMetaCtx(context.Background(), tb, callback)
+}
+
+// ForEachMessageMetaCtx calls back for each stored message, ordered by
+// CreatedAtColumn, then AggregateSequenceColumn, then ID.
+func (oa *OutboxAsserter) ForEachMessageMetaCtx(ctx context.Context, tb TB, callback func(*MessageMeta)) {
 	tb.Helper()
 	type msgRow struct {
+		ID          string
 		Destination string
 		Headers     string
 		Data        []byte
+		CreatedAt   sql.NullTime
+		Sequence    sql.NullInt64
+	}
+
+	columns := []string{oa.IDColumn, oa.DestinationColumn, oa.HeadersColumn, oa.DataColumn}
+	orderBy := []string{}
+	if oa.CreatedAtColumn != "" {
+		columns = append(columns, oa.CreatedAtColumn)
+		orderBy = append(orderBy, oa.CreatedAtColumn)
 	}
+	if oa.AggregateSequenceColumn != "" {
+		columns = append(columns, oa.AggregateSequenceColumn)
+		orderBy = append(orderBy, oa.AggregateSequenceColumn)
+	}
+	orderBy = append(orderBy, oa.IDColumn)
 
-	messageRows := []msgRow{}
-	if txErr := oa.db.Transact(context.Background(), nil, func(contextVal context.Context, tx sqrlx.Transaction) error {
+	var messageRows []msgRow
+	if txErr := oa.db.Transact(ctx, oa.TxOptions, func(contextVal context.Context, tx sqrlx.Transaction) error {
 		tb.Helper()
-		dataRows, err := tx.Select(contextVal, sq.Select(
-			oa.DestinationColumn,
-			oa.HeadersColumn,
-			oa.DataColumn,
-		).From(oa.TableName))
+		messageRows = []msgRow{}
+		dataRows, err := tx.Select(contextVal, oa.pending(sq.Select(columns...).
+			From(oa.TableName).
+			OrderBy(orderBy...)))
 		if err != nil {
 			return err
 		}
 		defer dataRows.Close()
 		for dataRows.Next() {
 			msgRow := msgRow{}
-			if scanErr := dataRows.Scan(&msgRow.Destination, &msgRow.Headers, &msgRow.Data); scanErr != nil {
+			dest := []interface{}{&msgRow.ID, &msgRow.Destination, &msgRow.Headers, &msgRow.Data}
+			if oa.CreatedAtColumn != "" {
+				dest = append(dest, &msgRow.CreatedAt)
+			}
+			if oa.AggregateSequenceColumn != "" {
+				dest = append(dest, &msgRow.Sequence)
+			}
+			if scanErr := dataRows.Scan(dest...); scanErr != nil {
 				return scanErr
 			}
 			messageRows = append(messageRows, msgRow)
 
 		}
-		return nil
+		return dataRows.Err()
 	}); txErr != nil {
-		tb.Fatal(txErr.Error())
+		tb.Fatal(contextError(ctx, txErr))
 	}
 
 	for _, msgRow := range messageRows {
-		storedHeaders, _ := url.ParseQuery(msgRow.Headers)
-		storedServiceHeader := storedHeaders.Get(oa.ServiceNameHeader)
-		callback(msgRow.Destination, storedServiceHeader, msgRow.Data)
+		storedHeaders, ok, err := oa.decodeHeaders(msgRow.ID, msgRow.Destination, msgRow.Headers, msgRow.Data)
+		if err != nil {
+			tb.Fatal(err.Error())
+		}
+		if !ok {
+			continue
+		}
+		payload, err := unwrapPayload(msgRow.Data, oa.AnyPayload)
+		if err != nil {
+			tb.Fatal(err.Error())
+		}
+		callback(&MessageMeta{
+			ID:          msgRow.ID,
+			Destination: msgRow.Destination,
+			Headers:     storedHeaders,
+			Data:        payload,
+			CreatedAt:   msgRow.CreatedAt.Time,
+			Sequence:    uint64(msgRow.Sequence.Int64),
+		})
 	}
 }
 
 func (oa *OutboxAsserter) AssertNoMessages(tb TB) {
 	tb.Helper()
-	msgCounts := []string{}
-	if txErr := oa.db.Transact(context.Background(), nil, func(contextVal context.Context, tx sqrlx.Transaction) error {
+	oa.AssertNoMessagesCtx(context.Background(), tb)
+}
+
+func (oa *OutboxAsserter) AssertNoMessagesCtx(ctx context.Context, tb TB) {
+	tb.Helper()
+	var msgCounts []string
+	if txErr := oa.db.Transact(ctx, oa.TxOptions, func(contextVal context.Context, tx sqrlx.Transaction) error {
 		tb.Helper()
-		dataRows, err := tx.Select(contextVal, sq.Select(
+		msgCounts = []string{}
+		dataRows, err := tx.Select(contextVal, oa.pending(sq.Select(
 			oa.DestinationColumn,
 			"count(*)",
 		).
 			From(oa.TableName).
 			GroupBy(oa.DestinationColumn).
-			Having("count(*) > 0"))
+			Having("count(*) > 0")))
 		if err != nil {
 			return err
 		}
@@ -273,7 +738,7 @@ func (oa *OutboxAsserter) AssertNoMessages(tb TB) {
 		}
 		return nil
 	}); txErr != nil {
-		tb.Fatal(txErr.Error())
+		tb.Fatal(contextError(ctx, txErr))
 	}
 	if len(msgCounts) != 0 {
 		tb.Fatalf("No messages expected, but found: %s", strings.Join(msgCounts, ", "))
@@ -281,16 +746,21 @@ func (oa *OutboxAsserter) AssertNoMessages(tb TB) {
 }
 
 func (oa *OutboxAsserter) AssertTopicIsEmpty(tb testing.TB, topic string) {
+	tb.Helper()
+	oa.AssertTopicIsEmptyCtx(context.Background(), tb, topic)
+}
+
+func (oa *OutboxAsserter) AssertTopicIsEmptyCtx(ctx context.Context, tb testing.TB, topic string) {
 	tb.Helper()
 	var msgCount uint64
-	if txErr := oa.db.Transact(context.Background(), nil, func(contextVal context.Context, tx sqrlx.Transaction) error {
-		return tx.SelectRow(contextVal, sq.
+	if txErr := oa.db.Transact(ctx, oa.TxOptions, func(contextVal context.Context, tx sqrlx.Transaction) error {
+		return tx.SelectRow(contextVal, oa.pending(sq.
 			Select("count(*)").
 			From(oa.TableName).
-			Where(sq.Eq{oa.DestinationColumn: topic})).
+			Where(sq.Eq{oa.DestinationColumn: topic}))).
 			Scan(&msgCount)
 	}); txErr != nil {
-		tb.Fatal(txErr.Error())
+		tb.Fatal(contextError(ctx, txErr))
 	}
 	if msgCount != 0 {
 		tb.Fatalf("No messages expected, but found %d", msgCount)
@@ -299,10 +769,15 @@ func (oa *OutboxAsserter) AssertTopicIsEmpty(tb testing.TB, topic string) {
 
 func (oa *OutboxAsserter) PurgeAll(tb TB) {
 	tb.Helper()
-	if txErr := oa.db.Transact(context.Background(), nil, func(contextVal context.Context, tx sqrlx.Transaction) error {
+	oa.PurgeAllCtx(context.Background(), tb)
+}
+
+func (oa *OutboxAsserter) PurgeAllCtx(ctx context.Context, tb TB) {
+	tb.Helper()
+	if txErr := oa.db.Transact(ctx, oa.TxOptions, func(contextVal context.Context, tx sqrlx.Transaction) error {
 		_, delErr := tx.Delete(contextVal, sq.Delete(oa.TableName))
 		return delErr
 	}); txErr != nil {
-		tb.Fatalf("Transaction Error %s", txErr.Error())
+		tb.Fatal("Transaction Error " + contextError(ctx, txErr))
 	}
 }
@@ -0,0 +1,229 @@
+package outboxtest
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pentops/outbox.pg.go/internal/fakedb"
+	"github.com/pentops/outbox.pg.go/outbox"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type testMessage struct {
+	*wrapperspb.StringValue
+	headers map[string]string
+}
+
+func newTestMessage(headers map[string]string) *testMessage {
+	return &testMessage{
+		StringValue: &wrapperspb.StringValue{},
+		headers:     headers,
+	}
+}
+
+func (msg *testMessage) MessagingTopic() string {
+	return "test.v1.Topic"
+}
+
+func (msg *testMessage) MessagingHeaders() map[string]string {
+	return msg.headers
+}
+
+type recordingTB struct {
+	failures []string
+}
+
+func (tb *recordingTB) Fatal(args ...any) {
+	tb.failures = append(tb.failures, fmt.Sprint(args...))
+}
+
+func (tb *recordingTB) Fatalf(format string, args ...any) {
+	tb.failures = append(tb.failures, fmt.Sprintf(format, args...))
+}
+
+func (tb *recordingTB) Helper() {}
+
+// storedRow returns a handler serving one stored message for every SELECT,
+// passing other statements to next.
+func storedRow(headers url.Values, value string, next fakedb.Handler) fakedb.Handler {
+	payload, err := proto.Marshal(wrapperspb.String(value))
+	if err != nil {
+		panic(err)
+	}
+	return func(query string, args []driver.NamedValue) (*fakedb.Result, error) {
+		if strings.HasPrefix(query, "SELECT") {
+			return &fakedb.Result{
+				Columns: []string{"id", "headers", "message"},
+				Rows:    [][]driver.Value{{"msg-1", headers.Encode(), payload}},
+			}, nil
+		}
+		return next(query, args)
+	}
+}
+
+func countPrefix(statements []string, prefix string) int {
+	count := 0
+	for _, statement := range statements {
+		if strings.HasPrefix(statement, prefix) {
+			count++
+		}
+	}
+	return count
+}
+
+func TestPopMessageRetries(t *testing.T) {
+	for _, tc := range []struct {
+		code    pq.ErrorCode
+		retried bool
+	}{
+		{code: "40001", retried: true}, // serialization_failure
+		{code: "40P01", retried: true}, // deadlock_detected
+		{code: "23505", retried: false},
+	} {
+		t.Run(string(tc.code), func(t *testing.T) {
+			failed := false
+			db := fakedb.Open(storedRow(url.Values{outbox.GRPCServiceHeader: {"/test.v1.Topic/Do"}}, "hello", func(query string, args []driver.NamedValue) (*fakedb.Result, error) {
+				if strings.HasPrefix(query, "DELETE") && !failed {
+					failed = true
+					return nil, &pq.Error{Code: tc.code, Message: "injected"}
+				}
+				return &fakedb.Result{RowsAffected: 1}, nil
+			}))
+
+			tb := &recordingTB{}
+			oa := NewOutboxAsserter(t, db.DB)
+			message := newTestMessage(map[string]string{outbox.GRPCServiceHeader: "/test.v1.Topic/Do"})
+			oa.PopMessage(tb, message)
+
+			statements := db.Statements()
+			if !tc.retried {
+				if len(tb.failures) != 1 {
+					t.Fatalf("expected the pop to fail, got %v", tb.failures)
+				}
+				if got := countPrefix(statements, "BEGIN"); got != 1 {
+					t.Errorf("expected no retry, got %d transactions", got)
+				}
+				return
+			}
+
+			if len(tb.failures) != 0 {
+				t.Fatalf("expected the pop to be retried, got %v", tb.failures)
+			}
+			if got := countPrefix(statements, "BEGIN"); got != 2 {
+				t.Errorf("expected 2 transactions, got %d", got)
+			}
+			if got := countPrefix(statements, "COMMIT"); got != 1 {
+				t.Errorf("expected 1 commit, got %d", got)
+			}
+			if message.Value != "hello" {
+				t.Errorf("expected the popped payload, got %q", message.Value)
+			}
+		})
+	}
+}
+
+func TestMatchersUseServiceNameHeader(t *testing.T) {
+	const serviceHeader = "x-service"
+	stored := url.Values{serviceHeader: {"/test.v1.Topic/Do"}}
+
+	for name, pop := range map[string]func(oa *OutboxAsserter, tb TB, matcher Matcher){
+		"PopMatching": func(oa *OutboxAsserter, tb TB, matcher Matcher) {
+			oa.PopMatching(tb, matcher)
+		},
+		"PopSet": func(oa *OutboxAsserter, tb TB, matcher Matcher) {
+			oa.PopSet(tb, matcher)
+		},
+		"AwaitDelivered": func(oa *OutboxAsserter, tb TB, matcher Matcher) {
+			oa.ArchiveTable = "outbox_archive"
+			oa.AwaitDelivered(tb, matcher, 100*time.Millisecond)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			db := fakedb.Open(storedRow(stored, "hello", func(string, []driver.NamedValue) (*fakedb.Result, error) {
+				return &fakedb.Result{RowsAffected: 1}, nil
+			}))
+			oa := NewOutboxAsserter(t, db.DB)
+			oa.ServiceNameHeader = serviceHeader
+
+			tb := &recordingTB{}
+			message := newTestMessage(map[string]string{serviceHeader: "/test.v1.Topic/Do"})
+			pop(oa, tb, NewMatcher(message).WhereHeader(serviceHeader))
+			if len(tb.failures) != 0 {
+				t.Fatalf("expected a match on %s, got %v", serviceHeader, tb.failures)
+			}
+			if message.Value != "hello" {
+				t.Errorf("expected the popped payload, got %q", message.Value)
+			}
+
+			tb = &recordingTB{}
+			other := newTestMessage(map[string]string{serviceHeader: "/test.v1.Topic/Other"})
+			pop(oa, tb, NewMatcher(other))
+			if len(tb.failures) != 1 {
+				t.Errorf("expected no match for another service, got %v", tb.failures)
+			}
+		})
+	}
+}
+
+func TestPopSetOverlappingMatchers(t *testing.T) {
+	service := url.Values{outbox.GRPCServiceHeader: {"/test.v1.Topic/Do"}}
+	tagged := url.Values{outbox.GRPCServiceHeader: {"/test.v1.Topic/Do"}, outbox.TagHeader: {"urgent"}}
+	rows := [][]driver.Value{}
+	for _, row := range []struct {
+		id      string
+		headers url.Values
+		value   string
+	}{
+		// the tagged message comes first, so a greedy broad matcher takes it
+		{"msg-1", tagged, "tagged"},
+		{"msg-2", service, "plain"},
+	} {
+		payload, err := proto.Marshal(wrapperspb.String(row.value))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, []driver.Value{row.id, row.headers.Encode(), payload})
+	}
+
+	for name, broadFirst := range map[string]bool{"broad first": true, "narrow first": false} {
+		t.Run(name, func(t *testing.T) {
+			var deleted []driver.NamedValue
+			db := fakedb.Open(func(query string, args []driver.NamedValue) (*fakedb.Result, error) {
+				switch {
+				case strings.HasPrefix(query, "SELECT"):
+					return &fakedb.Result{Columns: []string{"id", "headers", "message"}, Rows: rows}, nil
+				case strings.HasPrefix(query, "DELETE"):
+					deleted = args
+				}
+				return &fakedb.Result{RowsAffected: 2}, nil
+			})
+			oa := NewOutboxAsserter(t, db.DB)
+
+			headers := map[string]string{outbox.GRPCServiceHeader: "/test.v1.Topic/Do"}
+			broad := newTestMessage(headers)
+			narrow := newTestMessage(headers)
+			matchers := []Matcher{NewMatcher(broad), NewMatcher(narrow).WhereTag("urgent")}
+			if !broadFirst {
+				matchers[0], matchers[1] = matchers[1], matchers[0]
+			}
+
+			tb := &recordingTB{}
+			oa.PopSet(tb, matchers...)
+			if len(tb.failures) != 0 {
+				t.Fatalf("expected the set to match, got %v", tb.failures)
+			}
+			if len(deleted) != 2 {
+				t.Fatalf("expected both messages popped, got %v", deleted)
+			}
+			if narrow.Value != "tagged" || broad.Value != "plain" {
+				t.Errorf("matchers hold %q and %q, want the messages they were assigned", broad.Value, narrow.Value)
+			}
+		})
+	}
+}
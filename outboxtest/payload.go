@@ -0,0 +1,36 @@
+package outboxtest
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// unmarshalPayload decodes a stored payload, and when the payload is an
+// anypb.Any checks that it holds the type of message.
+func unmarshalPayload(data []byte, anyPayload bool, message proto.Message) error {
+	if !anyPayload {
+		return proto.Unmarshal(data, message)
+	}
+	wrapped := &anypb.Any{}
+	if err := proto.Unmarshal(data, wrapped); err != nil {
+		return err
+	}
+	if !wrapped.MessageIs(message) {
+		return fmt.Errorf("payload is %s, not %s", wrapped.TypeUrl, message.ProtoReflect().Descriptor().FullName())
+	}
+	return wrapped.UnmarshalTo(message)
+}
+
+// unwrapPayload returns the encoded message from a stored payload.
+func unwrapPayload(data []byte, anyPayload bool) ([]byte, error) {
+	if !anyPayload {
+		return data, nil
+	}
+	wrapped := &anypb.Any{}
+	if err := proto.Unmarshal(data, wrapped); err != nil {
+		return nil, err
+	}
+	return wrapped.Value, nil
+}
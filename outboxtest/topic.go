@@ -0,0 +1,157 @@
+package outboxtest
+
+import (
+	"context"
+	"fmt"
+
+	sq "github.com/elgris/sqrl"
+	"github.com/pentops/sqrlx.go/sqrlx"
+)
+
+// TopicAsserter scopes assertions to one topic, for tests which deal
+// mostly with one.
+type TopicAsserter struct {
+	oa    *OutboxAsserter
+	topic string
+}
+
+func (oa *OutboxAsserter) Topic(topic string) *TopicAsserter {
+	return &TopicAsserter{
+		oa:    oa,
+		topic: topic,
+	}
+}
+
+func (ta *TopicAsserter) Pop(tb TB, message OutboxMessage) {
+	tb.Helper()
+	ta.PopCtx(context.Background(), tb, message)
+}
+
+// PopCtx is PopMessageCtx, failing when the message isn't for the topic.
+func (ta *TopicAsserter) PopCtx(ctx context.Context, tb TB, message OutboxMessage) {
+	tb.Helper()
+	if topic := message.MessagingTopic(); topic != ta.topic {
+		tb.Fatalf("%T is for %s, not %s", message, topic, ta.topic)
+	}
+	ta.oa.PopMessageCtx(ctx, tb, message)
+}
+
+func (ta *TopicAsserter) PopMatching(tb TB, matcher Matcher) {
+	tb.Helper()
+	ta.PopMatchingCtx(context.Background(), tb, matcher)
+}
+
+func (ta *TopicAsserter) PopMatchingCtx(ctx context.Context, tb TB, matcher Matcher) {
+	tb.Helper()
+	if topic := matcher.MessagingTopic(); topic != ta.topic {
+		tb.Fatalf("%T is for %s, not %s", matcher, topic, ta.topic)
+	}
+	ta.oa.PopMatchingCtx(ctx, tb, matcher)
+}
+
+func (ta *TopicAsserter) Count(tb TB) int {
+	tb.Helper()
+	return ta.CountCtx(context.Background(), tb)
+}
+
+func (ta *TopicAsserter) CountCtx(ctx context.Context, tb TB) int {
+	tb.Helper()
+	var msgCount int
+	if txErr := ta.oa.db.Transact(ctx, ta.oa.TxOptions, func(ctx context.Context, tx sqrlx.Transaction) error {
+		return tx.SelectRow(ctx, ta.oa.pending(sq.
+			Select("count(*)").
+			From(ta.oa.TableName).
+			Where(sq.Eq{ta.oa.DestinationColumn: ta.topic}))).
+			Scan(&msgCount)
+	}); txErr != nil {
+		tb.Fatal(contextError(ctx, txErr))
+	}
+	return msgCount
+}
+
+func (ta *TopicAsserter) AssertEmpty(tb TB) {
+	tb.Helper()
+	ta.AssertEmptyCtx(context.Background(), tb)
+}
+
+func (ta *TopicAsserter) AssertEmptyCtx(ctx context.Context, tb TB) {
+	tb.Helper()
+	if msgCount := ta.CountCtx(ctx, tb); msgCount != 0 {
+		tb.Fatalf("No messages expected in %s, but found %d", ta.topic, msgCount)
+	}
+}
+
+func (ta *TopicAsserter) Drain(tb TB) []*MessageMeta {
+	tb.Helper()
+	return ta.DrainCtx(context.Background(), tb)
+}
+
+// DrainCtx pops every message on the topic, in the order of
+// ForEachMessageMeta.
+func (ta *TopicAsserter) DrainCtx(ctx context.Context, tb TB) []*MessageMeta {
+	tb.Helper()
+	oa := ta.oa
+
+	orderBy := []string{}
+	if oa.CreatedAtColumn != "" {
+		orderBy = append(orderBy, oa.CreatedAtColumn)
+	}
+	if oa.AggregateSequenceColumn != "" {
+		orderBy = append(orderBy, oa.AggregateSequenceColumn)
+	}
+	orderBy = append(orderBy, oa.IDColumn)
+
+	var drained []*MessageMeta
+	if txErr := oa.db.Transact(ctx, oa.TxOptions, func(ctx context.Context, tx sqrlx.Transaction) error {
+		drained = []*MessageMeta{}
+		rows, err := tx.Select(ctx, oa.pending(oa.messages(oa.TableName)).
+			Where(sq.Eq{oa.DestinationColumn: ta.topic}).
+			OrderBy(orderBy...))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		ids := []string{}
+		for rows.Next() {
+			var msgID string
+			var msgHeader string
+			var msgContent []byte
+			if err := rows.Scan(&msgID, &msgHeader, &msgContent); err != nil {
+				return err
+			}
+			headers, ok, err := oa.decodeHeaders(msgID, ta.topic, msgHeader, msgContent)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			payload, err := unwrapPayload(msgContent, oa.AnyPayload)
+			if err != nil {
+				return fmt.Errorf("message %s: %w", msgID, err)
+			}
+			ids = append(ids, msgID)
+			drained = append(drained, &MessageMeta{
+				ID:          msgID,
+				Destination: ta.topic,
+				Headers:     headers,
+				Data:        payload,
+			})
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		rows.Close()
+
+		if len(ids) == 0 {
+			return nil
+		}
+		_, err = tx.Delete(ctx, sq.Delete(oa.TableName).
+			Where(sq.Eq{oa.IDColumn: ids}))
+		return err
+	}); txErr != nil {
+		tb.Fatal(contextError(ctx, txErr))
+	}
+	return drained
+}